@@ -0,0 +1,414 @@
+package beardb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+//Data Structures
+/*=============================================================================
+Armadillo is a compressing wrapper over another BearStorage. The underlying
+storage starts with armadilloinfoLength bytes of header, followed by records.
+
+Record:
+-------------------------------------------------------
+|block int64|size int64|length uint32|crc uint32|data|
+-------------------------------------------------------
+The logical content is cut into blocks of blocksize bytes. Every record holds
+one whole logical block, compressed with flate. Block is the logical block
+number, size is the logical size of the storage when the record was written,
+length is the length of the compressed data and crc is its checksum.
+A record with block -1 and no data only records a change of size. A shrink
+is recorded when it is made, with the last block it cuts if any, so the
+blocks it drops stay dropped whatever is written after.
+
+Records are only ever appended, and the latest record of a block wins. The
+records are scanned on open to rebuild the block index, so ids remain logical
+offsets. A torn record at the end is discarded.
+Modified blocks are kept in memory and written when there are more than
+armadilloDirtyBlocks of them, on Sync or on Close. As with a raccoon, a write
+is only durable once Sync returns: until then up to armadilloDirtyBlocks
+blocks of it may be in memory only, and are lost in a crash.
+
+A record whose length is more than flate can make of a block, or runs past
+the end of the storage, is taken for a torn one.
+A storage shorter than the header had its header torn, and nothing written
+to it can have been durable, so it is created again.
+=============================================================================*/
+const (
+	armadilloinfoLength   = 16
+	armadilloRecordLength = 24
+	armadilloDirtyBlocks  = 16
+	armadilloMagic        = "BEARARMD"
+)
+
+type armadillo struct {
+	storage   BearStorage
+	blocksize int64
+	size      int64            //Logical size
+	tail      int64            //Where the next record goes
+	index     map[int64]int64  //Block number -> offset of its latest record
+	dirty     map[int64][]byte //Modified blocks not yet written
+	sizeDirty bool             //Size changed since the last record
+	zw        *flate.Writer
+	lock      sync.Mutex
+}
+
+//Wrap s into a compressing storage. If s is empty, a new armadillo of
+//blocksize bytes per block is created, otherwise blocksize is read from s.
+func NewArmadillo(s BearStorage, blocksize int) (*armadillo, error) {
+	a := &armadillo{storage: s, index: make(map[int64]int64),
+		dirty: make(map[int64][]byte)}
+	a.zw, _ = flate.NewWriter(nil, flate.BestSpeed)
+
+	header := make([]byte, armadilloinfoLength)
+	if size := s.Size(); size > 0 && size < armadilloinfoLength {
+		//A header cut short by a crash, with nothing written after it
+		if err := s.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	if s.Size() == 0 {
+		if blocksize <= 0 {
+			return nil, errors.New("Invalid block size")
+		}
+		copy(header, armadilloMagic)
+		binary.LittleEndian.PutUint32(header[8:], uint32(blocksize))
+		if _, err := s.WriteAt(header, 0); err != nil {
+			return nil, err
+		}
+		a.blocksize = int64(blocksize)
+		a.tail = armadilloinfoLength
+		return a, nil
+	}
+
+	if _, err := s.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:8]) != armadilloMagic {
+		return nil, errors.New("Not an armadillo storage")
+	}
+	a.blocksize = int64(binary.LittleEndian.Uint32(header[8:]))
+	if a.blocksize <= 0 {
+		return nil, errors.New("Invalid block size")
+	}
+	return a, a.scan()
+}
+
+//Longest compressed data a record of a block can hold. Flate adds 5 bytes to
+//every 64KB it cannot compress, and a few at the end.
+func (a *armadillo) maxLength() int64 {
+	return a.blocksize + (a.blocksize/65535+1)*5 + 16
+}
+
+//Length of the data of the record with header head at pos, checked against
+//what a record can hold and the end of the storage
+func (a *armadillo) recordLength(head []byte, pos int64) (int64, error) {
+	length := int64(binary.LittleEndian.Uint32(head[16:]))
+	if length > a.maxLength() || pos+armadilloRecordLength+length > a.storage.Size() {
+		return 0, errors.New("Armadillo record is corrupted")
+	}
+	return length, nil
+}
+
+//Rebuild the block index from the records
+func (a *armadillo) scan() error {
+	head := make([]byte, armadilloRecordLength)
+	pos := int64(armadilloinfoLength)
+	for {
+		if _, err := a.storage.ReadAt(head, pos); err != nil {
+			break
+		}
+		block := int64(binary.LittleEndian.Uint64(head[0:]))
+		size := int64(binary.LittleEndian.Uint64(head[8:]))
+		length, err := a.recordLength(head, pos)
+		if err != nil {
+			break
+		}
+		data := make([]byte, length)
+		if _, err := a.storage.ReadAt(data, pos+armadilloRecordLength); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(head[20:]) {
+			break
+		}
+		if block >= 0 {
+			a.index[block] = pos
+		}
+		a.size = size
+		a.dropBlocks()
+		pos += armadilloRecordLength + length
+	}
+	a.tail = pos
+	if pos < a.storage.Size() { //Torn record
+		return a.storage.Truncate(pos)
+	}
+	return nil
+}
+
+//Forget blocks lying entirely beyond the logical size
+func (a *armadillo) dropBlocks() {
+	count := (a.size + a.blocksize - 1) / a.blocksize
+	for block := range a.index {
+		if block >= count {
+			delete(a.index, block)
+		}
+	}
+	for block := range a.dirty {
+		if block >= count {
+			delete(a.dirty, block)
+		}
+	}
+}
+
+//Get the content of a block. The returned slice may be modified only if it
+//is dirty.
+func (a *armadillo) block(block int64) ([]byte, error) {
+	if data, ok := a.dirty[block]; ok {
+		return data, nil
+	}
+	data := make([]byte, a.blocksize)
+	pos, ok := a.index[block]
+	if !ok { //Never written, all zeros
+		return data, nil
+	}
+	head := make([]byte, armadilloRecordLength)
+	if _, err := a.storage.ReadAt(head, pos); err != nil {
+		return nil, err
+	}
+	length, err := a.recordLength(head, pos)
+	if err != nil {
+		return nil, err
+	}
+	compressed := make([]byte, length)
+	if _, err := a.storage.ReadAt(compressed, pos+armadilloRecordLength); err != nil {
+		return nil, err
+	}
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//Get a block for modifying, marking it dirty
+func (a *armadillo) dirtyBlock(block int64) ([]byte, error) {
+	data, err := a.block(block)
+	if err != nil {
+		return nil, err
+	}
+	a.dirty[block] = data
+	return data, nil
+}
+
+//Append a record
+func (a *armadillo) writeRecord(block int64, data []byte) error {
+	var compressed []byte
+	if data != nil {
+		buff := new(bytes.Buffer)
+		a.zw.Reset(buff)
+		a.zw.Write(data)
+		if err := a.zw.Close(); err != nil {
+			return err
+		}
+		compressed = buff.Bytes()
+	}
+	record := make([]byte, armadilloRecordLength+len(compressed))
+	binary.LittleEndian.PutUint64(record[0:], uint64(block))
+	binary.LittleEndian.PutUint64(record[8:], uint64(a.size))
+	binary.LittleEndian.PutUint32(record[16:], uint32(len(compressed)))
+	binary.LittleEndian.PutUint32(record[20:], crc32.ChecksumIEEE(compressed))
+	copy(record[armadilloRecordLength:], compressed)
+	if _, err := a.storage.WriteAt(record, a.tail); err != nil {
+		return err
+	}
+	if block >= 0 {
+		a.index[block] = a.tail
+	}
+	a.tail += int64(len(record))
+	return nil
+}
+
+//Write all dirty blocks
+func (a *armadillo) flush() error {
+	for block, data := range a.dirty {
+		if err := a.writeRecord(block, data); err != nil {
+			return err
+		}
+		delete(a.dirty, block)
+		a.sizeDirty = false
+	}
+	if a.sizeDirty {
+		if err := a.writeRecord(-1, nil); err != nil {
+			return err
+		}
+		a.sizeDirty = false
+	}
+	return nil
+}
+
+//Public methods
+//=============================================================================
+func (a *armadillo) ReadAt(p []byte, off int64) (n int, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	for n < len(p) && off < a.size {
+		block := off / a.blocksize
+		data, err := a.block(block)
+		if err != nil {
+			return n, err
+		}
+		start := off - block*a.blocksize
+		end := a.blocksize
+		if (block+1)*a.blocksize > a.size {
+			end = a.size - block*a.blocksize
+		}
+		copied := copy(p[n:], data[start:end])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+//Write p at off. It is durable once Sync returns.
+func (a *armadillo) WriteAt(p []byte, off int64) (n int, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for n < len(p) {
+		block := off / a.blocksize
+		data, err := a.dirtyBlock(block)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(data[off-block*a.blocksize:], p[n:])
+		n += copied
+		off += int64(copied)
+	}
+	if off > a.size {
+		a.size = off
+		a.sizeDirty = true
+	}
+	if len(a.dirty) > armadilloDirtyBlocks {
+		err = a.flush()
+	}
+	return
+}
+
+func (a *armadillo) Size() int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.size
+}
+
+func (a *armadillo) Truncate(size int64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if size < 0 {
+		return errors.New("Negative size")
+	}
+	if size >= a.size {
+		a.size = size
+		a.sizeDirty = true
+		return nil
+	}
+	//A shrink is recorded at once, so on open the blocks it drops are
+	//dropped before any record growing the storage again
+	block, last := size/a.blocksize, []byte(nil)
+	if size%a.blocksize != 0 { //Clear the rest of last block
+		data, err := a.dirtyBlock(block)
+		if err != nil {
+			return err
+		}
+		for i := size - block*a.blocksize; i < a.blocksize; i++ {
+			data[i] = 0
+		}
+		last = data
+	}
+	a.size = size
+	a.sizeDirty = true
+	a.dropBlocks()
+	if last == nil {
+		block = -1
+	}
+	if err := a.writeRecord(block, last); err != nil {
+		return err
+	}
+	delete(a.dirty, block)
+	a.sizeDirty = false
+	return nil
+}
+
+//Write all modified blocks to the underlying storage, and sync it if possible
+func (a *armadillo) Sync() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err := a.flush(); err != nil {
+		return err
+	}
+	if s, ok := a.storage.(interface {
+		Sync() error
+	}); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (a *armadillo) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if err := a.flush(); err != nil {
+		return err
+	}
+	return a.storage.Close()
+}
+
+//Write only the latest record of every block into an empty storage dst,
+//dropping the space taken by superseded records
+func (a *armadillo) CompactTo(dst BearStorage) (*armadillo, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	c, err := NewArmadillo(dst, int(a.blocksize))
+	if err != nil {
+		return nil, err
+	}
+	c.size = a.size
+	for block := range a.index {
+		data, err := a.block(block)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.writeRecord(block, data); err != nil {
+			return nil, err
+		}
+	}
+	for block, data := range a.dirty {
+		if err = c.writeRecord(block, data); err != nil {
+			return nil, err
+		}
+	}
+	return c, c.writeRecord(-1, nil)
+}
@@ -0,0 +1,73 @@
+package beardb
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+//The content survives reopening, and bytes cut off by a shrink stay gone
+//when the storage grows again
+func TestArmadilloReopen(t *testing.T) {
+	under := NewKoala(0)
+	a, err := NewArmadillo(under, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	model := make([]byte, 0)
+	for i := 0; i < 200; i++ {
+		off := rng.Int63n(300)
+		p := make([]byte, rng.Intn(40)+1)
+		rng.Read(p)
+		a.WriteAt(p, off)
+		if end := off + int64(len(p)); end > int64(len(model)) {
+			model = append(model, make([]byte, end-int64(len(model)))...)
+		}
+		copy(model[off:], p)
+	}
+	reopen := func(what string) {
+		if err = a.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if a, err = NewArmadillo(under, 0); err != nil {
+			t.Fatalf("reopening %s: %v", what, err)
+		}
+		got := make([]byte, a.Size())
+		a.ReadAt(got, 0)
+		if !bytes.Equal(got, model) {
+			t.Fatalf("content %s and reopening is wrong", what)
+		}
+	}
+	reopen("after writing")
+
+	for _, size := range []int64{0, 20} {
+		a.WriteAt(bytes.Repeat([]byte{1}, 48), 0)
+		a.Sync()
+		a.Truncate(size)
+		a.Truncate(48)
+		model = append(bytes.Repeat([]byte{1}, int(size)), make([]byte, 48-size)...)
+		reopen("after shrinking and growing again")
+	}
+}
+
+//A header torn in a crash leaves an empty armadillo
+func TestArmadilloTornHeader(t *testing.T) {
+	under := NewKoala(0)
+	under.WriteAt([]byte(armadilloMagic[:5]), 0)
+	a, err := NewArmadillo(under, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Size() != 0 {
+		t.Fatalf("size %d after a torn header", a.Size())
+	}
+	a.WriteAt([]byte("after"), 0)
+	a.Sync()
+	if a, err = NewArmadillo(under, 0); err != nil {
+		t.Fatal(err)
+	}
+	if a.Size() != 5 {
+		t.Fatalf("size %d after reopening, want 5", a.Size())
+	}
+}
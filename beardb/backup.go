@@ -0,0 +1,317 @@
+package beardb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+//Online backups
+/*=============================================================================
+A backup copies the storage up to the size it had when the backup started,
+chunk by chunk, holding the read lock only while reading a chunk. Appends
+go past that size and do not matter. Any other write is seen by the
+tracker before it reaches the storage, and the pages it is about to change
+are saved first if they have not been copied yet, so the backup is exactly
+the image at its start.
+
+Backup stream:
+--------------------------------------
+|magic|size int64|  image  |crc uint32|
+--------------------------------------
+=============================================================================*/
+const (
+	backupPage        = 4096
+	backupChunk       = 64 * backupPage
+	backupinfoLength  = 16
+	backupMagic       = "BEARBKUP"
+	backupTrailLength = 4
+)
+
+//Sits between the writers of a bear and its storage, and sees every write
+type tracker struct {
+	BearStorage
+	backups  []*backupState  //Running backups
+	modified *spans          //Overwritten since the last backup, nil if not tracked
+	since    int64           //Size at the last backup, -1 if none
+	replica  *replicationLog //Writes kept for followers, nil if not a primary
+	closed   bool            //Set once the bear is closed
+}
+
+//Must hold the write lock of the bear
+func (t *tracker) close() {
+	t.closed = true
+	if t.replica != nil {
+		t.replica.close()
+		t.replica = nil
+	}
+}
+
+//Must hold the write lock of the bear
+func (t *tracker) WriteAt(p []byte, off int64) (n int, err error) {
+	for _, b := range t.backups {
+		if err = b.preserve(t.BearStorage, off, int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	if t.modified != nil {
+		end := off + int64(len(p))
+		if size := t.Size(); end > size {
+			end = size
+		}
+		t.modified.add(off, end)
+	}
+	n, err = t.BearStorage.WriteAt(p, off)
+	for done := 0; done < n && t.replica != nil; done += replicationFrame { //In pieces a frame holds
+		end := done + replicationFrame
+		if end > n {
+			end = n
+		}
+		t.replica.append(replicationRecord{off: off + int64(done), data: append([]byte(nil), p[done:end]...)})
+	}
+	return
+}
+
+//Must hold the write lock of the bear
+func (t *tracker) Truncate(size int64) error {
+	for _, b := range t.backups { //Shrinking drops bytes still to be copied
+		if err := b.preserve(t.BearStorage, size, b.tail-size); err != nil {
+			return err
+		}
+	}
+	if t.modified != nil && size < t.since { //The chain of backups is broken
+		t.since = -1
+	}
+	if err := t.BearStorage.Truncate(size); err != nil {
+		return err
+	}
+	if t.replica != nil {
+		t.replica.append(replicationRecord{off: size, truncate: true})
+	}
+	return nil
+}
+
+//Sorted, disjoint ranges of bytes
+type span struct {
+	off, end int64
+}
+
+type spans []span
+
+//Add [off, end), merging with touching spans
+func (s *spans) add(off, end int64) {
+	if off >= end {
+		return
+	}
+	i := sort.Search(len(*s), func(i int) bool { return (*s)[i].end >= off })
+	j := i
+	for j < len(*s) && (*s)[j].off <= end {
+		if (*s)[j].off < off {
+			off = (*s)[j].off
+		}
+		if (*s)[j].end > end {
+			end = (*s)[j].end
+		}
+		j++
+	}
+	*s = append((*s)[:i], append(spans{{off, end}}, (*s)[j:]...)...)
+}
+
+//A running backup
+type backupState struct {
+	tail     int64            //Size when the backup started
+	copied   int64            //Everything before has been copied
+	saved    map[int64][]byte //Page number -> content when the backup started
+	tracked  bool             //Took over the tracked modifications
+	modified spans            //Overwritten between the last backup and this one
+	base     int64            //Size at the last backup
+}
+
+//Save the pages in [off, off+length) that are still to be copied
+func (b *backupState) preserve(s BearStorage, off, length int64) error {
+	end := off + length
+	if end > b.tail {
+		end = b.tail
+	}
+	if off < b.copied {
+		off = b.copied
+	}
+	if off >= end {
+		return nil
+	}
+	for page := off / backupPage; page*backupPage < end; page++ {
+		if _, ok := b.saved[page]; ok {
+			continue
+		}
+		size := b.tail - page*backupPage
+		if size > backupPage {
+			size = backupPage
+		}
+		data := make([]byte, size)
+		if _, err := s.ReadAt(data, page*backupPage); err != nil && err != io.EOF {
+			return err
+		}
+		b.saved[page] = data
+	}
+	return nil
+}
+
+//Start a backup of the image of t at this moment. If modifications are
+//tracked and track is true, they start over from here.
+func startBackup(lock *rwMutex, t *tracker, track bool) (*backupState, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if t.closed {
+		return nil, ErrClosed
+	}
+	b := &backupState{tail: t.Size(), saved: make(map[int64][]byte), base: -1}
+	if track && t.modified != nil {
+		b.tracked, b.modified, b.base = true, *t.modified, t.since
+		t.modified = new(spans)
+		t.since = b.tail
+	}
+	t.backups = append(t.backups, b)
+	return b, nil
+}
+
+//End a backup. If it failed, the modifications it took are given back.
+func endBackup(lock *rwMutex, t *tracker, b *backupState, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	for i := range t.backups {
+		if t.backups[i] == b {
+			t.backups = append(t.backups[:i], t.backups[i+1:]...)
+			break
+		}
+	}
+	if err != nil && b.tracked {
+		for _, s := range b.modified {
+			t.modified.add(s.off, s.end)
+		}
+		t.since = b.base
+	}
+}
+
+//Copy the image of a started backup into w and end it. Writers are never
+//blocked for longer than reading a chunk.
+func copyImage(lock *rwMutex, t *tracker, b *backupState, w io.Writer) (err error) {
+	defer func() { endBackup(lock, t, b, err) }()
+	return copySpans(lock, t, b, spans{{0, b.tail}}, w, nil)
+}
+
+//Copy the given ascending spans of the image of a started backup into w,
+//calling begin before each span
+func copySpans(lock *rwMutex, t *tracker, b *backupState, s spans, w io.Writer, begin func(span) error) error {
+	buff := make([]byte, backupChunk)
+	for _, sp := range s {
+		if begin != nil {
+			if err := begin(sp); err != nil {
+				return err
+			}
+		}
+		for off := sp.off; off < sp.end; {
+			n := sp.end - off
+			if n > backupChunk {
+				n = backupChunk
+			}
+			chunk := buff[:n]
+			lock.RLock()
+			if t.closed {
+				lock.RUnlock()
+				return ErrClosed
+			}
+			if _, err := t.ReadAt(chunk, off); err != nil && err != io.EOF {
+				lock.RUnlock()
+				return err
+			}
+			for page := off / backupPage; page*backupPage < off+n; page++ {
+				data, ok := b.saved[page]
+				if !ok {
+					continue
+				}
+				start := page * backupPage
+				if start < off {
+					copy(chunk, data[off-start:])
+				} else {
+					copy(chunk[start-off:], data)
+				}
+				if start+int64(len(data)) <= off+n {
+					delete(b.saved, page)
+				}
+			}
+			off += n
+			b.copied = off
+			lock.RUnlock()
+
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Write a consistent backup stream of t into w
+func backup(lock *rwMutex, t *tracker, w io.Writer) error {
+	b, err := startBackup(lock, t, true)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, backupinfoLength)
+	copy(header, backupMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(b.tail))
+	if _, err = w.Write(header); err != nil {
+		endBackup(lock, t, b, err)
+		return err
+	}
+	crc := crc32.NewIEEE()
+	if err = copyImage(lock, t, b, io.MultiWriter(w, crc)); err != nil {
+		return err
+	}
+	trail := make([]byte, backupTrailLength)
+	binary.LittleEndian.PutUint32(trail, crc.Sum32())
+	_, err = w.Write(trail)
+	return err
+}
+
+//Copy a consistent image of t into the storage dst, replacing its content
+func backupTo(lock *rwMutex, t *tracker, dst BearStorage) error {
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	b, err := startBackup(lock, t, true)
+	if err != nil {
+		return err
+	}
+	return copyImage(lock, t, b, &SafeWriter{dst, 0})
+}
+
+//Restore a backup stream made by Backup into the storage dst, replacing its
+//content. The checksum is verified after copying.
+func RestoreBackup(r io.Reader, dst BearStorage) error {
+	header := make([]byte, backupinfoLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:8]) != backupMagic {
+		return errors.New("Not a backup")
+	}
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	size := int64(binary.LittleEndian.Uint64(header[8:]))
+	crc := crc32.NewIEEE()
+	if _, err := io.CopyN(io.MultiWriter(&SafeWriter{dst, 0}, crc), r, size); err != nil {
+		return err
+	}
+	trail := make([]byte, backupTrailLength)
+	if _, err := io.ReadFull(r, trail); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(trail) != crc.Sum32() {
+		return errors.New("Backup checksum mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package beardb
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+//Batch reads
+/*=============================================================================
+GetMany sorts the ids, and ids close to each other are read from the storage
+in one ReadAt, from the first one to a little past the last one. Items are
+then decoded from memory, falling back to the storage for anything outside
+what was read, e.g. an item longer than the read-ahead.
+=============================================================================*/
+const (
+	batchGap       = 16 * 4096 //Ids closer than this are read together
+	batchReadahead = 4096      //Read past the last id of a group
+)
+
+var errBatchLength = errors.New("Ids and items differ in length")
+
+//A range of the storage read in one go
+type batchRange struct {
+	off  int64
+	data []byte
+	s    io.ReaderAt
+}
+
+func (b *batchRange) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.off && off+int64(len(p)) <= b.off+int64(len(b.data)) {
+		return copy(p, b.data[off-b.off:]), nil
+	}
+	return b.s.ReadAt(p, off)
+}
+
+//Read ids from s of the given size in as few ReadAt as possible. Returns the
+//indexes of ids in ascending order of id, and what to read each from.
+func readBatch(s io.ReaderAt, size int64, ids []int64) (order []int, readers []io.ReaderAt) {
+	order = make([]int, len(ids))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return ids[order[i]] < ids[order[j]] })
+
+	readers = make([]io.ReaderAt, len(ids))
+	for start := 0; start < len(order); {
+		end := start + 1
+		for end < len(order) && ids[order[end]]-ids[order[end-1]] <= batchGap {
+			end++
+		}
+		r := &batchRange{off: ids[order[start]], s: s}
+		last := ids[order[end-1]] + batchReadahead
+		if last > size {
+			last = size
+		}
+		if r.off >= 0 && r.off < last {
+			r.data = make([]byte, last-r.off)
+			if n, err := s.ReadAt(r.data, r.off); err != nil {
+				r.data = r.data[:n] //The rest comes from s, failing there
+			}
+		}
+		for _, i := range order[start:end] {
+			readers[i] = r
+		}
+		start = end
+	}
+	return
+}
+
+//Call decode for 0 to n-1 on all processors
+func decodeParallel(n int, decode func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				decode(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+//The same error for all n items
+func batchErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
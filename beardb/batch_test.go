@@ -0,0 +1,90 @@
+package beardb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//A storage counting its reads
+type readCounting struct {
+	BearStorage
+	reads int
+}
+
+func (c *readCounting) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.BearStorage.ReadAt(p, off)
+}
+
+func TestGetMany(t *testing.T) {
+	s := &readCounting{BearStorage: NewKoala(0)}
+	db := NewBrownBearDB(s)
+	w := db.NewSerializerWriter()
+	add := func(item string) int64 {
+		id, err := w.AddItem(NewString(item))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	var near, far []int64
+	for i := 0; i < 10; i++ {
+		near = append(near, add(fmt.Sprint("near ", i)))
+	}
+	near = append(near, add(strings.Repeat("long", batchReadahead))) //Past the read-ahead
+	for i := 0; i < 3; i++ {
+		add(strings.Repeat(" ", batchGap)) //Keeps the next one apart
+		far = append(far, add(fmt.Sprint("far ", i)))
+	}
+	if err := db.Delete(near[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	r := db.NewSerializerReader()
+	reads := 0 //Of the last GetMany
+	get := func(ids []int64) []error {
+		items := make([]Serializer, len(ids))
+		for i := range items {
+			items[i] = new(String)
+		}
+		before := s.reads
+		errs := r.GetMany(ids, items)
+		reads = s.reads - before
+		for i, id := range ids {
+			want := new(String)
+			err := r.GetItem(id, want)
+			if err != errs[i] || (err == nil && items[i].(*String).Get() != want.Get()) {
+				t.Fatalf("item %d of GetMany is %.20q, %v, GetItem gave %.20q, %v", i, items[i].(*String).Get(), errs[i], want.Get(), err)
+			}
+		}
+		return errs
+	}
+
+	//Adjacent ids in any order are read in one go
+	get([]int64{near[5], near[0], near[9], near[2], near[5]})
+	if reads != 1 {
+		t.Fatalf("%d reads for adjacent ids, want 1", reads)
+	}
+
+	//Ids far apart are read one by one
+	get(far)
+	if reads != len(far) {
+		t.Fatalf("%d reads for %d ids far apart, want %d", reads, len(far), len(far))
+	}
+
+	//A deleted id fails alone, and an item longer than what is read in one
+	//go is read from the storage
+	errs := get([]int64{near[3], near[4], near[10], far[1], near[3]})
+	if errs[0] != ErrDeleted || errs[4] != ErrDeleted {
+		t.Fatalf("deleted ids gave %v and %v", errs[0], errs[4])
+	}
+	for _, err := range errs[1:4] {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs := r.GetMany([]int64{near[0]}, nil); errs[0] != errBatchLength {
+		t.Fatalf("ids without items gave %v", errs[0])
+	}
+}
@@ -0,0 +1,143 @@
+package beardbtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//Enough items for a bear of several backup chunks
+const backupItems = 600
+
+//An item of the same length in every round
+func backupItem(round, i int) string {
+	return fmt.Sprintf("%04d-%04d-%01000d", round, i, 0)
+}
+
+//The parts of a bear the backup test needs
+type backupBear struct {
+	add      func(item string) (int64, error)
+	modify   func(id int64, item string) error
+	delete   func(id int64) error //Nil if the bear cannot delete
+	backup   func(w io.Writer) error
+	backupTo func(dst beardb.BearStorage) error
+}
+
+func backupBlack(s beardb.BearStorage) backupBear {
+	db := beardb.NewBlackBearDB(s)
+	w := db.NewSerializerWriter()
+	return backupBear{
+		add:      func(item string) (int64, error) { return w.AddItem(beardb.NewString(item)) },
+		modify:   func(id int64, item string) error { return w.Modify(id, beardb.NewString(item)) },
+		backup:   db.Backup,
+		backupTo: db.BackupTo,
+	}
+}
+
+func backupBrown(s beardb.BearStorage) backupBear {
+	db := beardb.NewBrownBearDB(s)
+	w := db.NewSerializerWriter()
+	return backupBear{
+		add:      func(item string) (int64, error) { return w.AddItem(beardb.NewString(item)) },
+		modify:   func(id int64, item string) error { return w.Modify(id, beardb.NewString(item)) },
+		delete:   db.Delete,
+		backup:   db.Backup,
+		backupTo: db.BackupTo,
+	}
+}
+
+//Calls change on every write before passing it on
+type changingWriter struct {
+	io.Writer
+	change func()
+}
+
+func (c *changingWriter) Write(p []byte) (int, error) {
+	c.change()
+	return c.Writer.Write(p)
+}
+
+//Calls change on every write before passing it on
+type changingStorage struct {
+	beardb.BearStorage
+	change func()
+}
+
+func (c *changingStorage) WriteAt(p []byte, off int64) (int, error) {
+	c.change()
+	return c.BearStorage.WriteAt(p, off)
+}
+
+func storageBytes(t *testing.T, s beardb.BearStorage) []byte {
+	b := make([]byte, s.Size())
+	if _, err := s.ReadAt(b, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//A backup taken while the bear is written holds the bytes it had when the
+//backup started
+func TestBackupPointInTime(t *testing.T) {
+	for _, kind := range []struct {
+		name string
+		open func(s beardb.BearStorage) backupBear
+	}{{"Black", backupBlack}, {"Brown", backupBrown}} {
+		t.Run(kind.name, func(t *testing.T) {
+			s := Koala()
+			bear := kind.open(s)
+			ids := make([]int64, backupItems)
+			for i := range ids {
+				var err error
+				if ids[i], err = bear.add(backupItem(0, i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			round := 0
+			change := func() { //All over the bear, and past its end
+				round++
+				for _, i := range []int{round % backupItems, backupItems / 2, backupItems - 1 - round%backupItems} {
+					if err := bear.modify(ids[i], backupItem(round, i)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := bear.add(backupItem(round, -1)); err != nil {
+					t.Fatal(err)
+				}
+				if bear.delete != nil {
+					if err := bear.delete(ids[backupItems/3+round]); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			want := storageBytes(t, s)
+			buff := new(bytes.Buffer)
+			if err := bear.backup(&changingWriter{buff, change}); err != nil {
+				t.Fatal(err)
+			}
+			if round < 3 {
+				t.Fatalf("the bear was written %d times during the backup", round)
+			}
+			restored := Koala()
+			if err := beardb.RestoreBackup(buff, restored); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(storageBytes(t, restored), want) {
+				t.Fatal("restored backup differs from the bear when it started")
+			}
+
+			want = storageBytes(t, s)
+			dst := Koala()
+			if err := bear.backupTo(&changingStorage{dst, change}); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(storageBytes(t, dst), want) {
+				t.Fatal("copy made by BackupTo differs from the bear when it started")
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package beardbtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//Long enough for Close to have returned if it did not wait
+const closeWait = 50 * time.Millisecond
+
+//A storage holding up the next write once armed, until it is released
+type gateStorage struct {
+	beardb.BearStorage
+	armed   bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *gateStorage) WriteAt(p []byte, off int64) (int, error) {
+	if g.armed {
+		g.armed = false
+		g.entered <- struct{}{}
+		<-g.release
+	}
+	return g.BearStorage.WriteAt(p, off)
+}
+
+//The parts of a bear the close test needs, with readers and writers of both
+//kinds made before closing
+type closeBear struct {
+	add    func(item string) (int64, error)
+	addGob func(item string) (int64, error)
+	get    func(id int64) (string, error)
+	getGob func(id int64) (string, error)
+	modify func(id int64, item string) error
+	close  func() error
+}
+
+func closeBlack(s beardb.BearStorage) closeBear {
+	db := beardb.NewBlackBearDB(s)
+	w, gw := db.NewSerializerWriter(), db.NewGobWriter()
+	r, gr := db.NewSerializerReader(), db.NewGobReader()
+	return closeBear{
+		add:    func(item string) (int64, error) { return w.AddItem(beardb.NewString(item)) },
+		addGob: func(item string) (int64, error) { return gw.AddItem(item) },
+		get: func(id int64) (string, error) {
+			item := new(beardb.String)
+			err := r.GetItem(id, item)
+			return item.Get(), err
+		},
+		getGob: func(id int64) (item string, err error) {
+			err = gr.GetItem(id, &item)
+			return
+		},
+		modify: func(id int64, item string) error { return w.Modify(id, beardb.NewString(item)) },
+		close:  db.Close,
+	}
+}
+
+func closeBrown(s beardb.BearStorage) closeBear {
+	db := beardb.NewBrownBearDB(s)
+	w, gw := db.NewSerializerWriter(), db.NewGobWriter()
+	r, gr := db.NewSerializerReader(), db.NewGobReader()
+	return closeBear{
+		add:    func(item string) (int64, error) { return w.AddItem(beardb.NewString(item)) },
+		addGob: func(item string) (int64, error) { return gw.AddItem(item) },
+		get: func(id int64) (string, error) {
+			item := new(beardb.String)
+			err := r.GetItem(id, item)
+			return item.Get(), err
+		},
+		getGob: func(id int64) (item string, err error) {
+			err = gr.GetItem(id, &item)
+			return
+		},
+		modify: func(id int64, item string) error { return w.Modify(id, beardb.NewString(item)) },
+		close:  db.Close,
+	}
+}
+
+func TestClose(t *testing.T) {
+	for name, open := range map[string]func(beardb.BearStorage) closeBear{
+		"Black": closeBlack,
+		"Brown": closeBrown,
+	} {
+		t.Run(name, func(t *testing.T) { testCloseBear(t, open) })
+	}
+}
+
+//Close waits for a writer in flight and keeps what it wrote, and every later
+//operation, through readers and writers made before, fails with ErrClosed
+func testCloseBear(t *testing.T, open func(beardb.BearStorage) closeBear) {
+	f := NewFaultStorage(Koala())
+	g := &gateStorage{BearStorage: f, entered: make(chan struct{}), release: make(chan struct{})}
+	db := open(g)
+	before, err := db.addGob("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.armed = true
+	type added struct {
+		id  int64
+		err error
+	}
+	writer := make(chan added, 1)
+	go func() {
+		id, err := db.add("in flight")
+		writer <- added{id, err}
+	}()
+	<-g.entered
+	closed := make(chan error, 1)
+	go func() { closed <- db.close() }()
+	select {
+	case err = <-closed:
+		t.Fatalf("Close returned %v before the writer in flight", err)
+	case <-time.After(closeWait):
+	}
+	close(g.release)
+	inFlight := <-writer
+	if inFlight.err != nil {
+		t.Fatalf("writer in flight failed with %v", inFlight.err)
+	}
+	if err = <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.add("after"); err != beardb.ErrClosed {
+		t.Fatalf("AddItem after Close gave %v", err)
+	}
+	if _, err = db.addGob("after"); err != beardb.ErrClosed {
+		t.Fatalf("gob AddItem after Close gave %v", err)
+	}
+	if err = db.modify(before, "after"); err != beardb.ErrClosed {
+		t.Fatalf("Modify after Close gave %v", err)
+	}
+	if _, err = db.get(before); err != beardb.ErrClosed {
+		t.Fatalf("GetItem after Close gave %v", err)
+	}
+	if _, err = db.getGob(before); err != beardb.ErrClosed {
+		t.Fatalf("gob GetItem after Close gave %v", err)
+	}
+	if err = db.close(); err != nil {
+		t.Fatalf("closing again gave %v", err)
+	}
+
+	db = open(f.Durable())
+	if item, err := db.getGob(before); err != nil || item != "before" {
+		t.Fatalf("item added before Close is %q, %v", item, err)
+	}
+	if item, err := db.get(inFlight.id); err != nil || item != "in flight" {
+		t.Fatalf("item added while closing is %q, %v", item, err)
+	}
+}
@@ -0,0 +1,193 @@
+package beardbtest
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//Crash consistency suites. newStorage must return an empty storage every
+//time it is called; the suites wrap it in a FaultStorage, open layer over
+//it unless layer is nil, write items and crash at random points. Then layer
+//is opened again over what survived, and every synced item must be there
+//and the database usable.
+//=============================================================================
+const crashRounds = 50
+
+//Open layer over f, or give f if layer is nil
+func openLayer(t *testing.T, layer Layer, f *FaultStorage) beardb.BearStorage {
+	if layer == nil {
+		return f
+	}
+	s, err := layer(f)
+	if err != nil {
+		t.Fatalf("opening the layer: %v", err)
+	}
+	return s
+}
+
+//Make what was written to s durable
+func syncLayer(s beardb.BearStorage) error {
+	return s.(interface {
+		Sync() error
+	}).Sync()
+}
+
+func crashItem(rng *rand.Rand, round, i int) string {
+	return fmt.Sprintf("round %d item %d %x", round, i, rng.Int63())
+}
+
+//Crash consistency of a blackBearDB written by Serializer writers
+func TestBlackCrashConsistency(t *testing.T, newStorage StorageFactory, layer Layer) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < crashRounds; round++ {
+		f := NewFaultStorage(newStorage())
+		s := openLayer(t, layer, f)
+		w := beardb.NewBlackBearDB(s).NewSerializerWriter()
+
+		var ids []int64
+		var items []string
+		synced := 0
+		for i := rng.Intn(20); i >= 0; i-- {
+			item := crashItem(rng, round, i)
+			id, err := w.AddItem(beardb.NewString(item))
+			if err != nil {
+				t.Fatalf("round %d: AddItem: %v", round, err)
+			}
+			ids, items = append(ids, id), append(items, item)
+			if rng.Intn(3) == 0 {
+				if err = syncLayer(s); err != nil {
+					t.Fatalf("round %d: Sync: %v", round, err)
+				}
+				synced = len(ids)
+			}
+		}
+		if rng.Intn(2) == 0 {
+			f.Crash()
+		} else {
+			f.CrashTorn(rng)
+		}
+
+		db := beardb.NewBlackBearDB(openLayer(t, layer, NewFaultStorage(f.Durable())))
+		r := db.NewSerializerReader()
+		for i := 0; i < synced; i++ {
+			got := new(beardb.String)
+			if err := r.GetItem(ids[i], got); err != nil {
+				t.Fatalf("round %d: synced item %d lost: %v", round, i, err)
+			}
+			if got.Get() != items[i] {
+				t.Fatalf("round %d: synced item %d is %q, want %q", round, i, got.Get(), items[i])
+			}
+		}
+
+		item := crashItem(rng, round, -1)
+		id, err := db.NewSerializerWriter().AddItem(beardb.NewString(item))
+		if err != nil {
+			t.Fatalf("round %d: AddItem after crash: %v", round, err)
+		}
+		got := new(beardb.String)
+		if err = r.GetItem(id, got); err != nil || got.Get() != item {
+			t.Fatalf("round %d: item added after crash is %q, %v", round, got.Get(), err)
+		}
+		db.Close()
+	}
+}
+
+//Crash consistency of a brownBearDB written by gob writers
+func TestBrownCrashConsistency(t *testing.T, newStorage StorageFactory, layer Layer) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < crashRounds; round++ {
+		f := NewFaultStorage(newStorage())
+		s := openLayer(t, layer, f)
+		w := beardb.NewBrownBearDB(s).NewGobWriter()
+
+		var ids []int64
+		var items []string
+		synced := 0
+		for i := rng.Intn(20); i >= 0; i-- {
+			item := crashItem(rng, round, i)
+			id, err := w.AddItem(item)
+			if err != nil {
+				t.Fatalf("round %d: AddItem: %v", round, err)
+			}
+			ids, items = append(ids, id), append(items, item)
+			if rng.Intn(3) == 0 {
+				if err = syncLayer(s); err != nil {
+					t.Fatalf("round %d: Sync: %v", round, err)
+				}
+				synced = len(ids)
+			}
+		}
+		if rng.Intn(2) == 0 {
+			f.Crash()
+		} else {
+			f.CrashTorn(rng)
+		}
+
+		//Gob type information is in the first item, so read in order
+		db := beardb.NewBrownBearDB(openLayer(t, layer, NewFaultStorage(f.Durable())))
+		r := db.NewGobReader()
+		for i := 0; i < synced; i++ {
+			var got string
+			if err := r.GetItem(ids[i], &got); err != nil {
+				t.Fatalf("round %d: synced item %d lost: %v", round, i, err)
+			}
+			if got != items[i] {
+				t.Fatalf("round %d: synced item %d is %q, want %q", round, i, got, items[i])
+			}
+		}
+
+		w = db.NewGobWriter()
+		item := crashItem(rng, round, -1)
+		id, err := w.AddItem(item)
+		if err != nil {
+			t.Fatalf("round %d: AddItem after crash: %v", round, err)
+		}
+		ids, items = append(ids[:synced], id), append(items[:synced], item)
+		if synced > 0 {
+			items[0] = crashItem(rng, round, -2) + " modified after crash"
+			if err = w.Modify(ids[0], items[0]); err != nil {
+				t.Fatalf("round %d: Modify after crash: %v", round, err)
+			}
+		}
+		for i := range ids {
+			var got string
+			if err := r.GetItem(ids[i], &got); err != nil || got != items[i] {
+				t.Fatalf("round %d: item %d after writing after crash is %q, %v, want %q", round, i, got, err, items[i])
+			}
+		}
+		db.Close()
+	}
+}
+
+//Failed writes must be reported by the writers instead of being swallowed.
+//A layer may hold writes back until it is synced, which must report them.
+func TestWriteFaults(t *testing.T, newStorage StorageFactory, layer Layer) {
+	f := NewFaultStorage(newStorage())
+	s := openLayer(t, layer, f)
+	black := beardb.NewBlackBearDB(s).NewSerializerWriter()
+	f.FailAfter(3)
+	if _, err := black.AddItem(beardb.NewString("longer than three bytes")); err == nil && syncLayer(s) == nil {
+		t.Fatal("blackBearDB: AddItem did not report the injected fault")
+	}
+	f.FailAfter(-1)
+	f.ShortWriteEvery(1)
+	if _, err := black.AddItem(beardb.NewInt64(42)); err == nil && syncLayer(s) == nil {
+		t.Fatal("blackBearDB: AddItem did not report the short write")
+	}
+
+	f = NewFaultStorage(newStorage())
+	s = openLayer(t, layer, f)
+	brown := beardb.NewBrownBearDB(s).NewGobWriter()
+	f.FailAfter(3)
+	if _, err := brown.AddItem("longer than three bytes"); err == nil && syncLayer(s) == nil {
+		t.Fatal("brownBearDB: AddItem did not report the injected fault")
+	}
+	f.FailAfter(-1)
+	f.ShortWriteEvery(1)
+	if _, err := brown.AddItems(42, 43); err == nil && syncLayer(s) == nil {
+		t.Fatal("brownBearDB: AddItems did not report the short write")
+	}
+}
@@ -0,0 +1,234 @@
+//Package beardbtest provides storages and test suites for testing code built
+//on beardb, and beardb itself.
+package beardbtest
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+var (
+	ErrInjected = errors.New("Injected fault")
+	ErrCrashed  = errors.New("Storage crashed")
+)
+
+//A pending write or truncate that has not been synced yet
+type pending struct {
+	data     []byte
+	off      int64
+	truncate bool //Truncate to off instead of writing data
+}
+
+//A BearStorage wrapping another one, which can be told to fail. Writes are
+//kept in memory until Sync, so a simulated crash loses everything unsynced,
+//just like a real disk losing its page cache.
+//=============================================================================
+type FaultStorage struct {
+	durable    beardb.BearStorage //What survives a crash
+	image      []byte             //What readers see
+	pending    []pending
+	failAfter  int64 //Bytes still allowed to be written, -1 for unlimited
+	shortEvery int   //Every shortEvery-th write is cut short, 0 for never
+	writes     int
+	delay      time.Duration
+	crashed    bool
+	lock       sync.Mutex
+}
+
+//Wrap s. The current content of s is taken as synced.
+func NewFaultStorage(s beardb.BearStorage) *FaultStorage {
+	f := &FaultStorage{durable: s, failAfter: -1}
+	f.image = make([]byte, s.Size())
+	s.ReadAt(f.image, 0)
+	return f
+}
+
+//Writes fail with ErrInjected once n more bytes have been written. The write
+//crossing the limit is applied partially. Negative n removes the limit.
+func (f *FaultStorage) FailAfter(n int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failAfter = n
+}
+
+//Every n-th write only writes half of its bytes and returns
+//io.ErrShortWrite. Zero n stops short writes.
+func (f *FaultStorage) ShortWriteEvery(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.shortEvery = n
+	f.writes = 0
+}
+
+//Sleep d before every operation
+func (f *FaultStorage) Delay(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.delay = d
+}
+
+//Simulate a crash, losing all unsynced writes. All later operations fail
+//with ErrCrashed.
+func (f *FaultStorage) Crash() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pending = nil
+	f.crashed = true
+}
+
+//Simulate a crash in the middle of writing back. A random number of the
+//unsynced operations reach the durable storage in order, and the next write
+//is torn at a random byte.
+func (f *FaultStorage) CrashTorn(rng *rand.Rand) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.pending) > 0 {
+		done := rng.Intn(len(f.pending) + 1)
+		f.apply(f.pending[:done])
+		if done < len(f.pending) && !f.pending[done].truncate {
+			torn := f.pending[done]
+			torn.data = torn.data[:rng.Intn(len(torn.data)+1)]
+			f.apply([]pending{torn})
+		}
+	}
+	f.pending = nil
+	f.crashed = true
+}
+
+//The wrapped storage, holding what survived. Wrap it again to restart.
+func (f *FaultStorage) Durable() beardb.BearStorage {
+	return f.durable
+}
+
+func (f *FaultStorage) apply(ops []pending) error {
+	for _, op := range ops {
+		var err error
+		if op.truncate {
+			err = f.durable.Truncate(op.off)
+		} else {
+			_, err = f.durable.WriteAt(op.data, op.off)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Wait the delay and check for crash. Must hold the lock.
+func (f *FaultStorage) enter() error {
+	if f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+	if f.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+//Public methods
+//=============================================================================
+func (f *FaultStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err = f.enter(); err != nil {
+		return
+	}
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off < int64(len(f.image)) {
+		n = copy(p, f.image[off:])
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *FaultStorage) WriteAt(p []byte, off int64) (n int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err = f.enter(); err != nil {
+		return
+	}
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	n = len(p)
+	f.writes++
+	if f.shortEvery > 0 && f.writes%f.shortEvery == 0 {
+		n, err = n/2, io.ErrShortWrite
+	}
+	if f.failAfter >= 0 {
+		if int64(n) > f.failAfter {
+			n, err = int(f.failAfter), ErrInjected
+		}
+		f.failAfter -= int64(n)
+	}
+
+	if n == 0 {
+		return
+	}
+	if end := off + int64(n); end > int64(len(f.image)) {
+		f.image = append(f.image, make([]byte, end-int64(len(f.image)))...)
+	}
+	copy(f.image[off:], p[:n])
+	f.pending = append(f.pending, pending{data: append([]byte(nil), p[:n]...), off: off})
+	return
+}
+
+func (f *FaultStorage) Truncate(size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.enter(); err != nil {
+		return err
+	}
+	if size < 0 {
+		return errors.New("Negative size")
+	}
+	if size <= int64(len(f.image)) {
+		f.image = f.image[:size:size]
+	} else {
+		f.image = append(f.image, make([]byte, size-int64(len(f.image)))...)
+	}
+	f.pending = append(f.pending, pending{off: size, truncate: true})
+	return nil
+}
+
+func (f *FaultStorage) Size() int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return int64(len(f.image))
+}
+
+//Write all pending operations to the wrapped storage
+func (f *FaultStorage) Sync() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.enter(); err != nil {
+		return err
+	}
+	err := f.apply(f.pending)
+	f.pending = nil
+	return err
+}
+
+//Pending operations survive a clean close, as the page cache is written
+//back eventually. The wrapped storage is left open to be wrapped again.
+func (f *FaultStorage) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.enter(); err != nil {
+		return err
+	}
+	err := f.apply(f.pending)
+	f.pending = nil
+	return err
+}
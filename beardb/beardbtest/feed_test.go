@@ -0,0 +1,263 @@
+package beardbtest
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//The parts of a bear the feed test needs
+type feedBear struct {
+	add       func(item string) (int64, error)
+	addItems  func(items ...string) (int64, error)
+	get       func(id int64) (string, error)
+	enable    func(s beardb.BearStorage) error
+	subscribe func() (<-chan beardb.Event, error)
+	close     func() error
+}
+
+func openBlack(s beardb.BearStorage) feedBear {
+	db := beardb.NewBlackBearDB(s)
+	w, r := db.NewSerializerWriter(), db.NewSerializerReader()
+	return feedBear{
+		add: func(item string) (int64, error) { return w.AddItem(beardb.NewString(item)) },
+		addItems: func(items ...string) (int64, error) {
+			s := make([]beardb.Serializer, len(items))
+			for i, item := range items {
+				s[i] = beardb.NewString(item)
+			}
+			return w.AddItems(s...)
+		},
+		get: func(id int64) (string, error) {
+			got := new(beardb.String)
+			err := r.GetItem(id, got)
+			return got.Get(), err
+		},
+		enable: db.EnableFeed,
+		subscribe: func() (<-chan beardb.Event, error) {
+			sub, err := db.Subscribe(-1, 0)
+			if err != nil {
+				return nil, err
+			}
+			return sub.C, nil
+		},
+		close: db.Close,
+	}
+}
+
+func openBrown(s beardb.BearStorage) feedBear {
+	db := beardb.NewBrownBearDB(s)
+	w, r := db.NewSerializerWriter(), db.NewSerializerReader()
+	return feedBear{
+		add: func(item string) (int64, error) { return w.AddItem(beardb.NewString(item)) },
+		addItems: func(items ...string) (int64, error) {
+			s := make([]beardb.Serializer, len(items))
+			for i, item := range items {
+				s[i] = beardb.NewString(item)
+			}
+			return w.AddItems(s...)
+		},
+		get: func(id int64) (string, error) {
+			got := new(beardb.String)
+			err := r.GetItem(id, got)
+			return got.Get(), err
+		},
+		enable: db.EnableFeed,
+		subscribe: func() (<-chan beardb.Event, error) {
+			sub, err := db.Subscribe(-1, 0)
+			if err != nil {
+				return nil, err
+			}
+			return sub.C, nil
+		},
+		close: db.Close,
+	}
+}
+
+//Collect the events of a bear until it is closed
+func feedEvents(t *testing.T, db feedBear) []beardb.Event {
+	c, err := db.subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.close() //Ends the subscription once it has caught up
+	var events []beardb.Event
+	for e := range c {
+		events = append(events, e)
+	}
+	return events
+}
+
+//A storage counting its syncs
+type syncCounting struct {
+	beardb.BearStorage
+	syncs int
+}
+
+func (s *syncCounting) Sync() error {
+	s.syncs++
+	return nil
+}
+
+//The feed is synced once for a write of many items
+func TestFeedSyncPerWrite(t *testing.T) {
+	for name, open := range map[string]func(beardb.BearStorage) feedBear{
+		"Black": openBlack,
+		"Brown": openBrown,
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := open(Koala())
+			ff := &syncCounting{BearStorage: Koala()}
+			if err := db.enable(ff); err != nil {
+				t.Fatal(err)
+			}
+			items := []string{"a", "bb", "ccc", "dddd"}
+			first, err := db.addItems(items...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ff.syncs != 1 {
+				t.Fatalf("%d syncs of the feed for AddItems, want 1", ff.syncs)
+			}
+			for i, e := range feedEvents(t, db) {
+				if e.Kind != beardb.EventAppend || e.Unconfirmed {
+					t.Fatalf("event %d is %+v", i, e)
+				}
+				if i == 0 && e.ID != first {
+					t.Fatalf("first append at %d, AddItems gave %d", e.ID, first)
+				}
+			}
+		})
+	}
+}
+
+//A storage calling crash on the next write once it is set, and failing
+//every write from then on
+type crashingStorage struct {
+	beardb.BearStorage
+	crash   func()
+	crashed bool
+}
+
+func (c *crashingStorage) WriteAt(p []byte, off int64) (int, error) {
+	if c.crash != nil && !c.crashed {
+		c.crash()
+		c.crashed = true
+	}
+	if c.crashed {
+		return 0, ErrInjected
+	}
+	return c.BearStorage.WriteAt(p, off)
+}
+
+//A change logged in the feed but never made, as the bear crashed before
+//writing it, is delivered as unconfirmed after the crash
+func TestFeedUnconfirmed(t *testing.T) {
+	for name, open := range map[string]func(beardb.BearStorage) feedBear{
+		"Black": openBlack,
+		"Brown": openBrown,
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := &crashingStorage{BearStorage: Koala()}
+			ff := NewFaultStorage(Koala())
+			db := open(s)
+			if err := db.enable(ff); err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range []string{"first", "second"} {
+				if _, err := db.add(item); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var feed []byte //What survives of the feed
+			s.crash = func() { feed = storageBytes(t, ff.Durable()) }
+			lost, err := db.add("lost")
+			if err == nil {
+				t.Fatal("write to a crashing storage succeeded")
+			}
+
+			db = open(s.BearStorage)
+			if item, err := db.get(lost); err == nil && item == "lost" {
+				t.Fatal("the lost item is there")
+			}
+			recovered := Koala()
+			if _, err = recovered.WriteAt(feed, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err = db.enable(recovered); err != nil {
+				t.Fatal(err)
+			}
+			events := feedEvents(t, db)
+			if len(events) != 3 {
+				t.Fatalf("%d events after the crash, want 3", len(events))
+			}
+			for i, e := range events {
+				if e.Unconfirmed != (i == 2) {
+					t.Fatalf("event %d is %+v", i, e)
+				}
+			}
+		})
+	}
+}
+
+//Every item that survives a crash has its append in the feed, synced or not
+func TestFeedCrashConsistency(t *testing.T) {
+	t.Run("Black", func(t *testing.T) { testFeedCrash(t, openBlack) })
+	t.Run("Brown", func(t *testing.T) { testFeedCrash(t, openBrown) })
+}
+
+func testFeedCrash(t *testing.T, open func(s beardb.BearStorage) feedBear) {
+	rng := rand.New(rand.NewSource(1))
+	crash := func(f *FaultStorage) {
+		if rng.Intn(2) == 0 {
+			f.Crash()
+		} else {
+			f.CrashTorn(rng)
+		}
+	}
+	for round := 0; round < crashRounds; round++ {
+		f, ff := NewFaultStorage(Koala()), NewFaultStorage(Koala())
+		db := open(f)
+		if err := db.enable(ff); err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		var items []string
+		for i := rng.Intn(20); i >= 0; i-- {
+			item := crashItem(rng, round, i)
+			id, err := db.add(item)
+			if err != nil {
+				t.Fatalf("round %d: AddItem: %v", round, err)
+			}
+			ids, items = append(ids, id), append(items, item)
+			if rng.Intn(3) == 0 {
+				f.Sync() //The data only, the feed syncs itself
+			}
+		}
+		crash(f)
+		crash(ff)
+
+		db = open(NewFaultStorage(f.Durable()))
+		var survived []int64
+		for i, id := range ids {
+			if got, err := db.get(id); err == nil && got == items[i] {
+				survived = append(survived, id)
+			}
+		}
+		if err := db.enable(NewFaultStorage(ff.Durable())); err != nil {
+			t.Fatalf("round %d: EnableFeed after crash: %v", round, err)
+		}
+		appends := make(map[int64]bool)
+		for _, e := range feedEvents(t, db) {
+			if e.Kind == beardb.EventAppend {
+				appends[e.ID] = true
+			}
+		}
+		for _, id := range survived {
+			if !appends[id] {
+				t.Fatalf("round %d: item at %d survived without its append in the feed", round, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package beardbtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//A storage counting its reads
+type countingStorage struct {
+	beardb.BearStorage
+	reads int
+}
+
+func (c *countingStorage) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.BearStorage.ReadAt(p, off)
+}
+
+func hashKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%d", i))
+}
+
+//Enough keys for several splits
+const hashKeys = 3000
+
+func TestHashIndexReopen(t *testing.T) {
+	s := Koala()
+	h, err := beardb.NewHashIndex(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < hashKeys; i++ {
+		if err = h.Put(hashKey(i), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < hashKeys; i += 2 {
+		if err = h.Delete(hashKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Put(hashKey(1), -1)
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h, err = beardb.NewHashIndex(s, nil); err != nil {
+		t.Fatal(err)
+	}
+	if h.Len() != hashKeys/2 {
+		t.Fatalf("%d keys after reopening, want %d", h.Len(), hashKeys/2)
+	}
+	for i := 0; i < hashKeys; i++ {
+		want := int64(i)
+		if i == 1 {
+			want = -1
+		}
+		id, err := h.Get(hashKey(i))
+		if i%2 == 0 && err != beardb.ErrNotFound {
+			t.Fatalf("deleted key %d gave %d, %v after reopening", i, id, err)
+		}
+		if i%2 == 1 && (err != nil || id != want) {
+			t.Fatalf("key %d gave %d, %v after reopening, want %d", i, id, err, want)
+		}
+	}
+}
+
+//A fault in the storage leaves the change it cut short in the journal, to
+//be made by the next change or on the next open
+func TestHashIndexWriteFault(t *testing.T) {
+	t.Run("Crash", func(t *testing.T) { testHashIndexWriteFault(t, false) })
+	t.Run("PutAgain", func(t *testing.T) { testHashIndexWriteFault(t, true) })
+}
+
+func testHashIndexWriteFault(t *testing.T, again bool) {
+	for limit, done := int64(1), false; !done; limit += 1999 {
+		s, j := NewFaultStorage(Koala()), NewFaultStorage(Koala())
+		h, err := beardb.NewHashIndex(s, j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.FailAfter(limit)
+		n := 0 //Keys put
+		for done = true; n < hashKeys/4; {
+			err = h.Put(hashKey(n), int64(n))
+			n++ //Even if it failed, the journal holds it
+			if err != nil {
+				done = false
+				break
+			}
+		}
+		if id, err := h.Get(hashKey(n - 1)); err != nil || id != int64(n-1) {
+			t.Fatalf("limit %d: key put last gave %d, %v", limit, id, err)
+		}
+		if again {
+			s.FailAfter(-1)
+			for i := 0; i < 10; i++ {
+				if err = h.Put(hashKey(n), int64(n)); err != nil {
+					t.Fatalf("limit %d: Put after the fault: %v", limit, err)
+				}
+				n++
+			}
+		}
+		s.Crash()
+		j.Crash()
+
+		if h, err = beardb.NewHashIndex(NewFaultStorage(s.Durable()), NewFaultStorage(j.Durable())); err != nil {
+			t.Fatalf("limit %d: reopening: %v", limit, err)
+		}
+		if h.Len() != int64(n) {
+			t.Fatalf("limit %d: %d keys after recovery, want %d", limit, h.Len(), n)
+		}
+		for i := 0; i < n; i++ {
+			if id, err := h.Get(hashKey(i)); err != nil || id != int64(i) {
+				t.Fatalf("limit %d: key %d gave %d, %v after recovery", limit, i, id, err)
+			}
+		}
+	}
+}
+
+//Lookups of missing keys that read the storage, of n
+func missingReads(t *testing.T, h interface {
+	Get(key []byte) (int64, error)
+}, c *countingStorage, n int) int {
+	read := 0
+	for i := 0; i < n; i++ {
+		before := c.reads
+		if _, err := h.Get([]byte(fmt.Sprintf("missing%d", i))); err != beardb.ErrNotFound {
+			t.Fatalf("missing key gave %v", err)
+		}
+		if c.reads > before {
+			read++
+		}
+	}
+	return read
+}
+
+func TestHashIndexFalsePositives(t *testing.T) {
+	for _, rate := range []float64{0, 0.01} {
+		c := &countingStorage{BearStorage: Koala()}
+		h, err := beardb.NewFilteredHashIndex(c, nil, rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < hashKeys; i++ {
+			h.Put(hashKey(i), int64(i))
+		}
+		read := missingReads(t, h, c, hashKeys)
+		if rate == 0 && read != hashKeys {
+			t.Fatalf("without filters %d of %d missing keys were read", read, hashKeys)
+		}
+		if rate > 0 && float64(read) > 3*rate*hashKeys {
+			t.Fatalf("with a false positive rate of %v, %d of %d missing keys were read", rate, read, hashKeys)
+		}
+
+		//The rate it was created with is kept
+		h.Close()
+		if h, err = beardb.NewFilteredHashIndex(c, nil, 0.5); err != nil {
+			t.Fatal(err)
+		}
+		if again := missingReads(t, h, c, hashKeys); again != read {
+			t.Fatalf("%d missing keys were read after reopening, %d before", again, read)
+		}
+		for i := 0; i < hashKeys; i++ {
+			if id, err := h.Get(hashKey(i)); err != nil || id != int64(i) {
+				t.Fatalf("key %d gave %d, %v", i, id, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package beardbtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//A full backup and two incremental ones, each with the bytes the bear had
+//when it was taken
+type backupChain struct {
+	full, first, second []byte
+	images              [3][]byte
+}
+
+func makeChain(t *testing.T) *backupChain {
+	s := Koala()
+	db := beardb.NewBlackBearDB(s)
+	w := db.NewSerializerWriter()
+	var ids []int64
+	add := func(n int) {
+		for i := 0; i < n; i++ {
+			id, err := w.AddItem(beardb.NewInt64(int64(len(ids))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+	}
+	modify := func(step int) {
+		for i := 0; i < len(ids); i += step {
+			if err := w.Modify(ids[i], beardb.NewInt64(int64(-i*step))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c := new(backupChain)
+	add(2000)
+	buff := new(bytes.Buffer)
+	if err := db.Backup(buff); err != nil {
+		t.Fatal(err)
+	}
+	c.full, c.images[0] = buff.Bytes(), storageBytes(t, s)
+
+	modify(7)
+	add(500)
+	buff = new(bytes.Buffer)
+	if err := db.IncrementalBackup(buff); err != nil {
+		t.Fatal(err)
+	}
+	c.first, c.images[1] = buff.Bytes(), storageBytes(t, s)
+
+	modify(13)
+	add(500)
+	buff = new(bytes.Buffer)
+	if err := db.IncrementalBackup(buff); err != nil {
+		t.Fatal(err)
+	}
+	c.second, c.images[2] = buff.Bytes(), storageBytes(t, s)
+	return c
+}
+
+func TestIncrementalChain(t *testing.T) {
+	c := makeChain(t)
+	dst := Koala()
+	if err := beardb.RestoreBackup(bytes.NewReader(c.full), dst); err != nil {
+		t.Fatal(err)
+	}
+	for i, inc := range [][]byte{c.first, c.second} {
+		if err := beardb.ApplyIncremental(bytes.NewReader(inc), dst); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(storageBytes(t, dst), c.images[i+1]) {
+			t.Fatalf("image after incremental backup %d differs from the bear", i+1)
+		}
+	}
+
+	dst = Koala()
+	err := beardb.RestoreChain(dst, bytes.NewReader(c.full), bytes.NewReader(c.first), bytes.NewReader(c.second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storageBytes(t, dst), c.images[2]) {
+		t.Fatal("image restored from the chain differs from the bear")
+	}
+}
+
+//Apply inc to a restore of the full backup of c and the incrementals
+//before, wanting it to fail and leave the image as it was
+func applyFails(t *testing.T, c *backupChain, before [][]byte, inc []byte, what string) {
+	dst := Koala()
+	if err := beardb.RestoreBackup(bytes.NewReader(c.full), dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range before {
+		if err := beardb.ApplyIncremental(bytes.NewReader(b), dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := storageBytes(t, dst)
+	if err := beardb.ApplyIncremental(bytes.NewReader(inc), dst); err == nil {
+		t.Fatalf("applying %s succeeded", what)
+	}
+	if !bytes.Equal(storageBytes(t, dst), want) {
+		t.Fatalf("applying %s changed the image", what)
+	}
+}
+
+func TestIncrementalWrongBase(t *testing.T) {
+	c := makeChain(t)
+	applyFails(t, c, nil, c.second, "the second incremental backup to the full one")
+	applyFails(t, c, [][]byte{c.first, c.second}, c.first, "an incremental backup twice")
+}
+
+func TestIncrementalCorrupted(t *testing.T) {
+	c := makeChain(t)
+	const header, rangeHead = 28, 12
+	if binary.LittleEndian.Uint32(c.first[24:]) == 0 {
+		t.Fatal("the incremental backup has no overwritten range")
+	}
+
+	bad := append([]byte(nil), c.first...)
+	bad[header+rangeHead] ^= 1 //In the data of the first range
+	applyFails(t, c, nil, bad, "a backup with a flipped byte in a range")
+
+	bad = append([]byte(nil), c.first...)
+	binary.LittleEndian.PutUint64(bad[header:], binary.LittleEndian.Uint64(bad[16:])) //Range at tail
+	applyFails(t, c, nil, bad, "a backup with a range past its base")
+
+	bad = append([]byte(nil), c.first...)
+	binary.LittleEndian.PutUint32(bad[header+8:], 1<<31) //Range of 2GB
+	applyFails(t, c, nil, bad, "a backup with a range too long")
+
+	applyFails(t, c, nil, c.first[:len(c.first)-1], "a truncated backup")
+}
@@ -0,0 +1,64 @@
+package beardbtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+func TestBearKV(t *testing.T) {
+	s, index, journal := Koala(), Koala(), Koala()
+	kv, err := beardb.NewBearKV(beardb.NewBrownBearDB(s), index, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err = kv.Put(fmt.Sprint(i), beardb.NewInt64(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		if err = kv.Put(fmt.Sprint(i), beardb.NewInt64(int64(-i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < n; i += 3 {
+		if err = kv.Delete(fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = kv.Delete("missing"); err != beardb.ErrNotFound {
+		t.Fatalf("deleting a missing key gave %v", err)
+	}
+	kv.Close()
+
+	if kv, err = beardb.NewBearKV(beardb.NewBrownBearDB(s), index, journal); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(n - (n+1)/3); kv.Len() != want {
+		t.Fatalf("%d keys after reopening, want %d", kv.Len(), want)
+	}
+	for i := 0; i < n; i++ {
+		got := beardb.NewInt64(0)
+		err := kv.Get(fmt.Sprint(i), got)
+		switch i % 3 {
+		case 0:
+			if err != nil || got.Get() != int64(-i) {
+				t.Fatalf("key %d gave %d, %v, want %d", i, got.Get(), err, -i)
+			}
+		case 1:
+			if err != beardb.ErrNotFound {
+				t.Fatalf("deleted key %d gave %v", i, err)
+			}
+		case 2:
+			if err != nil || got.Get() != int64(i) {
+				t.Fatalf("key %d gave %d, %v, want %d", i, got.Get(), err, i)
+			}
+		}
+	}
+	if _, err = kv.ID("missing"); err != beardb.ErrNotFound {
+		t.Fatalf("a missing key gave %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package beardbtest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//A storage counting its writes
+type writeCounting struct {
+	beardb.BearStorage
+	writes int
+}
+
+func (c *writeCounting) WriteAt(p []byte, off int64) (int, error) {
+	c.writes++
+	return c.BearStorage.WriteAt(p, off)
+}
+
+//A connection between a primary and a follower, until cut
+type replicationLink struct {
+	primary, follower net.Conn
+	done              chan error
+}
+
+func link(serve, run func(conn io.ReadWriter) error) *replicationLink {
+	l := &replicationLink{done: make(chan error, 2)}
+	l.primary, l.follower = net.Pipe()
+	go func() { l.done <- serve(l.primary) }()
+	go func() { l.done <- run(l.follower) }()
+	return l
+}
+
+//Close the connection and wait for both sides to return
+func (l *replicationLink) cut() {
+	l.primary.Close()
+	l.follower.Close()
+	<-l.done
+	<-l.done
+}
+
+func TestReplication(t *testing.T) {
+	pdb := beardb.NewBlackBearDB(Koala())
+	w := pdb.NewSerializerWriter()
+	items := make(map[int64]string)
+	var last int64
+	add := func(n int, item func(i int) string) {
+		for i := 0; i < n; i++ {
+			s := item(len(items))
+			id, err := w.AddItem(beardb.NewString(s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			items[id], last = s, id
+		}
+	}
+	add(100, strconv.Itoa)
+	p, err := pdb.NewPrimary(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	fdb := beardb.NewBlackBearDB(Koala())
+	scratch := &writeCounting{BearStorage: Koala()}
+	f := fdb.NewFollower(beardb.Position{}, scratch)
+	r := fdb.NewSerializerReader()
+	check := func(what string) {
+		got := new(beardb.String)
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+			if err := r.GetItem(last, got); err == nil && got.Get() == items[last] {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the last item never reached the follower by %s", what)
+			}
+		}
+		for id, want := range items {
+			if err := r.GetItem(id, got); err != nil || got.Get() != want {
+				t.Fatalf("item %d is %.20q, %v by %s, want %.20q", id, got.Get(), err, what, want)
+			}
+		}
+	}
+
+	l := link(p.Serve, f.Run)
+	check("the initial resync")
+	//Writes longer than a frame are sent in pieces
+	add(10, func(i int) string { return strings.Repeat(fmt.Sprint(i), 100000) })
+	check("streaming")
+	l.cut()
+	images := scratch.writes
+	if images == 0 {
+		t.Fatal("the initial resync did not go through the scratch storage")
+	}
+	if scratch.Size() != 0 {
+		t.Fatalf("scratch storage left with %d bytes", scratch.Size())
+	}
+
+	add(5, strconv.Itoa)
+	l = link(p.Serve, f.Run)
+	check("resuming")
+	l.cut()
+	if scratch.writes != images {
+		t.Fatal("resuming sent an image")
+	}
+
+	//Too many writes to be kept for the follower
+	add(100, strconv.Itoa)
+	l = link(p.Serve, f.Run)
+	check("the second resync")
+	l.cut()
+	if scratch.writes == images {
+		t.Fatal("a follower behind what is kept got no image")
+	}
+}
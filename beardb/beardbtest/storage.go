@@ -0,0 +1,297 @@
+package beardbtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//Storage conformance suite. Every BearStorage must behave like a file:
+//writes past the end zero-fill the gap, writes in the middle only replace
+//the bytes written, reads past the end return io.EOF and Truncate both
+//shrinks and zero-fills.
+//=============================================================================
+//Returns a new, empty storage every time it is called
+type StorageFactory func() beardb.BearStorage
+
+//Opens a storage layered over s, such as an armadillo: a new one if s is
+//empty, and the one s holds otherwise
+type Layer func(s beardb.BearStorage) (beardb.BearStorage, error)
+
+//Factory of koalas
+func Koala() beardb.BearStorage {
+	return beardb.NewKoala(0)
+}
+
+//Factory of raccoons in new files under dir
+func Raccoon(dir string) StorageFactory {
+	count := 0
+	return func() beardb.BearStorage {
+		count++
+		path := filepath.Join(dir, fmt.Sprintf("raccoon-%d", count))
+		os.Remove(path)
+		return beardb.NewRaccoon(path)
+	}
+}
+
+//Run the whole suite against the storages made by newStorage
+func TestStorage(t *testing.T, newStorage StorageFactory) {
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, newStorage()) })
+	t.Run("Offsets", func(t *testing.T) { testOffsets(t, newStorage()) })
+	t.Run("ReadPastEnd", func(t *testing.T) { testReadPastEnd(t, newStorage()) })
+	t.Run("Truncate", func(t *testing.T) { testTruncate(t, newStorage()) })
+	t.Run("Random", func(t *testing.T) { testRandom(t, newStorage()) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, newStorage()) })
+	t.Run("ConcurrentAppend", func(t *testing.T) { testConcurrentAppend(t, newStorage()) })
+	t.Run("Close", func(t *testing.T) { testClose(t, newStorage()) })
+}
+
+//Check that s holds exactly want
+func expectContent(t *testing.T, s beardb.BearStorage, want []byte) {
+	t.Helper()
+	if size := s.Size(); size != int64(len(want)) {
+		t.Fatalf("Size() = %d, want %d", size, len(want))
+	}
+	got := make([]byte, len(want))
+	if n, err := s.ReadAt(got, 0); n != len(want) || (err != nil && err != io.EOF) {
+		t.Fatalf("ReadAt(%d bytes, 0) = %d, %v", len(want), n, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("content is %v, want %v", got, want)
+	}
+}
+
+//Write p at off, both to s and to the model
+func writeBoth(t *testing.T, s beardb.BearStorage, model []byte, p []byte, off int64) []byte {
+	t.Helper()
+	if n, err := s.WriteAt(p, off); n != len(p) || err != nil {
+		t.Fatalf("WriteAt(%d bytes, %d) = %d, %v", len(p), off, n, err)
+	}
+	if len(p) == 0 {
+		return model
+	}
+	if end := off + int64(len(p)); end > int64(len(model)) {
+		model = append(model, make([]byte, end-int64(len(model)))...)
+	}
+	copy(model[off:], p)
+	return model
+}
+
+func testEmpty(t *testing.T, s beardb.BearStorage) {
+	defer s.Close()
+	expectContent(t, s, nil)
+}
+
+func testOffsets(t *testing.T, s beardb.BearStorage) {
+	defer s.Close()
+	var model []byte
+	model = writeBoth(t, s, model, []byte("0123456789"), 0)
+	model = writeBoth(t, s, model, []byte("ab"), 3) //Short write in the middle
+	expectContent(t, s, model)
+	model = writeBoth(t, s, model, []byte("xyz"), 8) //Overlapping the end
+	expectContent(t, s, model)
+	model = writeBoth(t, s, model, []byte("gap"), 20) //Past the end
+	expectContent(t, s, model)
+	model = writeBoth(t, s, model, []byte("fill"), 14) //Into the gap
+	expectContent(t, s, model)
+	model = writeBoth(t, s, model, nil, 100) //Empty writes do not grow
+	expectContent(t, s, model)
+}
+
+func testReadPastEnd(t *testing.T, s beardb.BearStorage) {
+	defer s.Close()
+	p := make([]byte, 4)
+	if n, err := s.ReadAt(p, 0); n != 0 || err != io.EOF {
+		t.Fatalf("ReadAt on empty storage = %d, %v, want 0, io.EOF", n, err)
+	}
+	writeBoth(t, s, nil, []byte("hello"), 0)
+	if n, err := s.ReadAt(p, 3); n != 2 || err != io.EOF {
+		t.Fatalf("ReadAt across the end = %d, %v, want 2, io.EOF", n, err)
+	}
+	if string(p[:2]) != "lo" {
+		t.Fatalf("ReadAt across the end read %q, want \"lo\"", p[:2])
+	}
+	if n, err := s.ReadAt(p, 5); n != 0 || err != io.EOF {
+		t.Fatalf("ReadAt at the end = %d, %v, want 0, io.EOF", n, err)
+	}
+	if n, err := s.ReadAt(p, 50); n != 0 || err != io.EOF {
+		t.Fatalf("ReadAt past the end = %d, %v, want 0, io.EOF", n, err)
+	}
+	if n, err := s.ReadAt(p, 1); n != 4 || err != nil {
+		t.Fatalf("ReadAt inside = %d, %v, want 4, nil", n, err)
+	}
+}
+
+//Truncate s and the model to size
+func truncateBoth(t *testing.T, s beardb.BearStorage, model []byte, size int64) []byte {
+	t.Helper()
+	if err := s.Truncate(size); err != nil {
+		t.Fatalf("Truncate(%d) = %v", size, err)
+	}
+	if size <= int64(len(model)) {
+		return model[:size:size]
+	}
+	return append(model, make([]byte, size-int64(len(model)))...)
+}
+
+func testTruncate(t *testing.T, s beardb.BearStorage) {
+	defer s.Close()
+	var model []byte
+	model = writeBoth(t, s, model, []byte("0123456789"), 0)
+	model = truncateBoth(t, s, model, 4) //Shrink
+	expectContent(t, s, model)
+	model = truncateBoth(t, s, model, 12) //Grow, the old bytes must not come back
+	expectContent(t, s, model)
+	model = truncateBoth(t, s, model, 12) //Same size
+	expectContent(t, s, model)
+	model = writeBoth(t, s, model, []byte("ab"), 11) //Write across the new end
+	expectContent(t, s, model)
+	model = truncateBoth(t, s, model, 0)
+	expectContent(t, s, model)
+	model = writeBoth(t, s, model, []byte("after"), 3)
+	expectContent(t, s, model)
+}
+
+func testRandom(t *testing.T, s beardb.BearStorage) {
+	defer s.Close()
+	rng := rand.New(rand.NewSource(1))
+	var model []byte
+	for i := 0; i < 500; i++ {
+		if rng.Intn(10) == 0 {
+			model = truncateBoth(t, s, model, int64(rng.Intn(len(model)+64)))
+		} else {
+			p := make([]byte, rng.Intn(64))
+			rng.Read(p)
+			model = writeBoth(t, s, model, p, int64(rng.Intn(len(model)+64)))
+		}
+		if i%50 == 0 {
+			expectContent(t, s, model)
+		}
+	}
+	expectContent(t, s, model)
+}
+
+func testConcurrent(t *testing.T, s beardb.BearStorage) {
+	defer s.Close()
+	const workers, rounds, length = 8, 100, 64
+	var wg sync.WaitGroup
+	errs := make(chan string, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			off := int64(w * length)
+			p := make([]byte, length)
+			got := make([]byte, length)
+			for r := 0; r < rounds; r++ {
+				for i := range p {
+					p[i] = byte(w + r)
+				}
+				if _, err := s.WriteAt(p, off); err != nil {
+					errs <- err.Error()
+					return
+				}
+				if _, err := s.ReadAt(got, off); err != nil && err != io.EOF {
+					errs <- err.Error()
+					return
+				}
+				if !bytes.Equal(got, p) {
+					errs <- "read back different bytes from a region no one else writes"
+					return
+				}
+				s.Size()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	want := make([]byte, workers*length)
+	for i := range want {
+		want[i] = byte(i/length + rounds - 1)
+	}
+	expectContent(t, s, want)
+}
+
+//Appenders grabbing the end under their own lock, the way the bears do,
+//while others keep asking for the size
+func testConcurrentAppend(t *testing.T, s beardb.BearStorage) {
+	defer s.Close()
+	const workers, rounds, length = 8, 50, 16
+	var wg, readers sync.WaitGroup
+	var lock sync.Mutex
+	done := make(chan struct{})
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			last := int64(0)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				size := s.Size()
+				if size < last {
+					t.Error("Size() went backwards while only appending")
+					return
+				}
+				last = size
+			}
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			p := bytes.Repeat([]byte{byte(w + 1)}, length)
+			for r := 0; r < rounds; r++ {
+				lock.Lock()
+				_, err := s.WriteAt(p, s.Size())
+				lock.Unlock()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	if size := s.Size(); size != workers*rounds*length {
+		t.Fatalf("Size() = %d after appending, want %d", size, workers*rounds*length)
+	}
+	counts := make(map[byte]int)
+	got := make([]byte, length)
+	for off := int64(0); off < workers*rounds*length; off += length {
+		s.ReadAt(got, off)
+		if !bytes.Equal(got, bytes.Repeat(got[:1], length)) {
+			t.Fatalf("appends interleaved at %d: %v", off, got)
+		}
+		counts[got[0]]++
+	}
+	for w := 0; w < workers; w++ {
+		if counts[byte(w+1)] != rounds {
+			t.Fatalf("worker %d appended %d times, want %d", w, counts[byte(w+1)], rounds)
+		}
+	}
+}
+
+func testClose(t *testing.T, s beardb.BearStorage) {
+	writeBoth(t, s, nil, []byte("closing"), 0)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+}
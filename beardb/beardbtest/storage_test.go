@@ -0,0 +1,59 @@
+package beardbtest
+
+import (
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//A storage every suite is run against: layer over what newStorage makes,
+//or what newStorage makes if layer is nil
+type storageKind struct {
+	newStorage StorageFactory
+	layer      Layer
+}
+
+//Factory of the storage of k
+func (k storageKind) factory() StorageFactory {
+	if k.layer == nil {
+		return k.newStorage
+	}
+	return func() beardb.BearStorage {
+		s, err := k.layer(k.newStorage())
+		if err != nil {
+			panic(err)
+		}
+		return s
+	}
+}
+
+//The storages every suite is run against
+func storages(t *testing.T) map[string]storageKind {
+	key := make([]byte, 32)
+	return map[string]storageKind{
+		"Koala":   {Koala, nil},
+		"Raccoon": {Raccoon(t.TempDir()), nil},
+		"Armadillo": {Koala, func(s beardb.BearStorage) (beardb.BearStorage, error) {
+			return beardb.NewArmadillo(s, 4096)
+		}},
+		"Pangolin": {Raccoon(t.TempDir()), func(s beardb.BearStorage) (beardb.BearStorage, error) {
+			return beardb.NewPangolin(s, key, 4096)
+		}},
+	}
+}
+
+func TestStorages(t *testing.T) {
+	for name, kind := range storages(t) {
+		t.Run(name, func(t *testing.T) { TestStorage(t, kind.factory()) })
+	}
+}
+
+//Layers have the FaultStorage under them, and are opened again over what
+//survives a crash
+func TestCrashConsistency(t *testing.T) {
+	for name, kind := range storages(t) {
+		t.Run(name+"/Black", func(t *testing.T) { TestBlackCrashConsistency(t, kind.newStorage, kind.layer) })
+		t.Run(name+"/Brown", func(t *testing.T) { TestBrownCrashConsistency(t, kind.newStorage, kind.layer) })
+		t.Run(name+"/WriteFaults", func(t *testing.T) { TestWriteFaults(t, kind.newStorage, kind.layer) })
+	}
+}
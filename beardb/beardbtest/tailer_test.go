@@ -0,0 +1,75 @@
+package beardbtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//Long enough for a tailer to have returned if it was not blocked
+const tailerWait = 50 * time.Millisecond
+
+//A tailer reads what is there, blocks at the end until an append wakes it,
+//and returns once ctx is done or the bear is closed
+func TestTailer(t *testing.T) {
+	db := beardb.NewBlackBearDB(Koala())
+	w := db.NewSerializerWriter()
+	first, err := w.AddItem(beardb.NewString("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail := db.NewSerializerTailer(first)
+	got := new(beardb.String)
+	if err = tail.Next(context.Background(), got); err != nil || got.Get() != "first" {
+		t.Fatalf("first item is %q, %v", got.Get(), err)
+	}
+
+	next := func(ctx context.Context) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- tail.Next(ctx, got) }()
+		select {
+		case err := <-done:
+			t.Fatalf("Next returned %v at the end", err)
+		case <-time.After(tailerWait):
+		}
+		return done
+	}
+	done := next(context.Background())
+	second, err := w.AddItem(beardb.NewString("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil || got.Get() != "second" {
+			t.Fatalf("appended item is %q, %v", got.Get(), err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Next did not wake up on an append")
+	}
+	if tail.Position() <= second {
+		t.Fatalf("position %d is not past the item read at %d", tail.Position(), second)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done = next(ctx)
+	cancel()
+	if err = <-done; err != context.Canceled {
+		t.Fatalf("Next gave %v once ctx was done", err)
+	}
+
+	done = next(context.Background())
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != beardb.ErrClosed {
+			t.Fatalf("Next gave %v once the bear was closed", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Next did not return on Close")
+	}
+}
@@ -0,0 +1,87 @@
+package beardbtest
+
+import (
+	"testing"
+
+	"github.com/sgsdxzy/BearDB/beardb"
+)
+
+//A write fault in the middle of a commit leaves the transaction to be
+//completed from the WAL, by the next commit or on the next open
+func TestTxWriteFault(t *testing.T) {
+	t.Run("Crash", func(t *testing.T) { testTxWriteFault(t, false) })
+	t.Run("CommitAgain", func(t *testing.T) { testTxWriteFault(t, true) })
+}
+
+func testTxWriteFault(t *testing.T, again bool) {
+	for limit, done := int64(1), false; !done; limit += 3 {
+		f, journal := NewFaultStorage(Koala()), NewFaultStorage(Koala())
+		db := beardb.NewBrownBearDB(f)
+		if err := db.SetWAL(journal); err != nil {
+			t.Fatal(err)
+		}
+		w := db.NewSerializerWriter()
+		var ids []int64
+		for i := int64(0); i < 3; i++ {
+			id, err := w.AddItem(beardb.NewInt64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		f.Sync()
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range ids[:2] {
+			w.ModifyTx(tx, id, beardb.NewInt64(int64(10+i)))
+		}
+		tx.Delete(ids[2])
+		f.FailAfter(limit)
+		_, err = tx.Commit()
+		done = err == nil //The fault is past the writes of the commit
+		if again {
+			f.FailAfter(-1)
+			if tx, err = db.Begin(); err != nil {
+				t.Fatal(err)
+			}
+			w.AddItemsTx(tx, beardb.NewInt64(30))
+			added, err := tx.Commit()
+			if err != nil {
+				t.Fatalf("limit %d: commit after the fault: %v", limit, err)
+			}
+			ids = append(ids, added[0])
+		}
+		f.Crash()
+		journal.Crash()
+
+		db = beardb.NewBrownBearDB(NewFaultStorage(f.Durable()))
+		if err = db.SetWAL(NewFaultStorage(journal.Durable())); err != nil {
+			t.Fatalf("limit %d: SetWAL: %v", limit, err)
+		}
+		r := db.NewSerializerReader()
+		for i, id := range ids[:2] {
+			got := beardb.NewInt64(0)
+			if err = r.GetItem(id, got); err != nil || got.Get() != int64(10+i) {
+				t.Fatalf("limit %d: item %d is %d, %v after recovery, want %d", limit, i, got.Get(), err, 10+i)
+			}
+		}
+		if err = r.GetItem(ids[2], beardb.NewInt64(0)); err != beardb.ErrDeleted {
+			t.Fatalf("limit %d: deleted item gave %v after recovery", limit, err)
+		}
+		if again {
+			got := beardb.NewInt64(0)
+			if err = r.GetItem(ids[3], got); err != nil || got.Get() != 30 {
+				t.Fatalf("limit %d: item added after the fault is %d, %v after recovery", limit, got.Get(), err)
+			}
+		}
+	}
+}
+
+func TestBeginWithoutWAL(t *testing.T) {
+	if _, err := beardb.NewBrownBearDB(Koala()).Begin(); err != beardb.ErrNoWAL {
+		t.Fatalf("Begin without a WAL gave %v, want ErrNoWAL", err)
+	}
+}
@@ -1,15 +1,20 @@
 package beardb
 
 import (
+	"context"
 	"encoding/gob"
-	"sync"
+	"errors"
+	"io"
 )
 
 //The compact and most simplified append-and-read-only database
 //=============================================================================
 type blackBearDB struct {
 	storage BearStorage
-	rwlock  sync.RWMutex //Appending lock
+	tracker tracker   //All writes go through it
+	rwlock  rwMutex   //Appending lock
+	feed    *feed     //Changes are recorded here, nil if not enabled
+	changed broadcast //Wakes up tailers
 }
 
 //Non-locking getting size
@@ -17,11 +22,74 @@ func (db *blackBearDB) size() int64 {
 	return db.storage.Size()
 }
 
+//Durably log changes in the feed, if any, before they are made. Must hold
+//the write lock.
+func (db *blackBearDB) logChanges(records ...feedRecord) error {
+	if db.feed == nil {
+		return nil
+	}
+	return db.feed.log(records...)
+}
+
+//Deliver the first n changes logged in the feed, if any, dropping the rest,
+//and wake up tailers. Must hold the write lock. Err is returned if not nil.
+func (db *blackBearDB) publish(n int, err error) error {
+	db.changed.notify()
+	if db.feed == nil {
+		return err
+	}
+	if perr := db.feed.publish(n); err == nil {
+		err = perr
+	}
+	return err
+}
+
+//Collects appends in memory, to be written in one go
+type appendBuffer struct {
+	base int64
+	data []byte
+}
+
+func (a *appendBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off != a.base+int64(len(a.data)) {
+		return 0, errors.New("Write is not an append")
+	}
+	a.data = append(a.data, p...)
+	return len(p), nil
+}
+
+//Append count items, encoding item i through w, in one write after logging
+//them all in the feed at once. Must hold the write lock.
+func (db *blackBearDB) appendItems(w *SafeWriter, count int, encode func(i int) error) (id int64, err error) {
+	id = db.size()
+	buff := &appendBuffer{base: id}
+	w.WriterAt, w.Offset = buff, id
+	defer func() { w.WriterAt = &db.tracker }()
+	var records []feedRecord
+	for i := 0; i < count; i++ {
+		off := w.Offset
+		if err = encode(i); err != nil {
+			break
+		}
+		records = append(records, feedRecord{off, off, EventAppend})
+	}
+	if lerr := db.logChanges(records...); lerr != nil {
+		return -1, db.publish(0, lerr)
+	}
+	if len(buff.data) > 0 {
+		if _, werr := db.tracker.WriteAt(buff.data, id); werr != nil {
+			return id, db.publish(0, werr)
+		}
+	}
+	return id, db.publish(len(records), err)
+}
+
 //Public methods
 //=============================================================================
 //Constructor
 func NewBlackBearDB(s BearStorage) *blackBearDB {
-	return &blackBearDB{storage: s}
+	return &blackBearDB{storage: s,
+		tracker: tracker{BearStorage: s, modified: new(spans), since: -1}}
 }
 
 //Get current size
@@ -31,9 +99,129 @@ func (db *blackBearDB) Size() int64 {
 	return db.size()
 }
 
-//Make sure to close it before exit! Better use defer.
+//Wait for running operations, then sync and close the storage. Later
+//operations fail with ErrClosed, and closing again does nothing. Make sure
+//to close it before exit! Better use defer.
 func (db *blackBearDB) Close() error {
-	return db.storage.Close()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.tracker.closed {
+		return nil
+	}
+	db.tracker.close()
+	db.changed.notify()
+	var err error
+	if db.feed != nil {
+		err = db.feed.close()
+	}
+	if serr := syncStorage(db.storage); err == nil {
+		err = serr
+	}
+	if cerr := db.storage.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//Take the write lock of an open database, giving up once ctx is done
+func (db *blackBearDB) lock(ctx context.Context) error {
+	return lockOpen(ctx, &db.rwlock, &db.tracker)
+}
+
+//Take the read lock of an open database, giving up once ctx is done
+func (db *blackBearDB) rlock(ctx context.Context) error {
+	return lockOpen(ctx, db.rwlock.RLocker(), &db.tracker)
+}
+
+//Write a checkpoint of a koala-backed database to path in the background.
+//Writers are only blocked while taking the image. The returned channel
+//delivers the result. Restore with koala.FromFile.
+func (db *blackBearDB) Checkpoint(path string) <-chan error {
+	return checkpoint(db.rwlock.RLocker(), &db.tracker, path)
+}
+
+//Write a consistent backup of the database into w while it stays in use.
+//Restore with RestoreBackup.
+func (db *blackBearDB) Backup(w io.Writer) error {
+	return backup(&db.rwlock, &db.tracker, w)
+}
+
+//Copy a consistent image of the database into dst while it stays in use.
+//Dst can be opened as a database directly.
+func (db *blackBearDB) BackupTo(dst BearStorage) error {
+	return backupTo(&db.rwlock, &db.tracker, dst)
+}
+
+//Make the database a primary, keeping the latest retain writes in memory for
+//followers to catch up from. Serve followers with primary.Serve.
+func (db *blackBearDB) NewPrimary(retain int) (*primary, error) {
+	return newPrimary(&db.rwlock, &db.tracker, retain)
+}
+
+//Make the database a follower, resuming from a saved position or starting
+//from the zero Position. Connect it to the primary with follower.Run. An
+//image of the primary is received into scratch, a temporary storage, before
+//it replaces the content of the bear. With scratch nil it is kept in memory.
+func (db *blackBearDB) NewFollower(from Position, scratch BearStorage) *follower {
+	return newFollower(&db.rwlock, &db.tracker, from, scratch)
+}
+
+//Write the changes since the last backup into w, while the database stays
+//in use. There must have been a Backup, BackupTo or IncrementalBackup
+//since the database was opened. Restore with RestoreChain.
+func (db *blackBearDB) IncrementalBackup(w io.Writer) error {
+	return incrementalBackup(&db.rwlock, &db.tracker, w)
+}
+
+//Wait until there is an item at r, then read it with decode. Appends are
+//whole under the write lock, so any byte past r starts a complete item.
+func (db *blackBearDB) next(ctx context.Context, r *SafeReader, decode func() error) error {
+	for {
+		changed := db.changed.wait() //Before looking, so no append is missed
+		if err := db.rlock(ctx); err != nil {
+			return err
+		}
+		if r.Offset < db.size() {
+			defer db.rwlock.RUnlock()
+			return decode()
+		}
+		db.rwlock.RUnlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//Record every change from now on in s, which keeps the feed across restarts.
+//Enable it before any writing to have every entry in it.
+func (db *blackBearDB) EnableFeed(s BearStorage) error {
+	if err := db.lock(context.Background()); err != nil {
+		return err
+	}
+	defer db.rwlock.Unlock()
+	if db.feed != nil {
+		return errors.New("Feed already enabled")
+	}
+	f, err := newFeed(s)
+	if err != nil {
+		return err
+	}
+	db.feed = f
+	return nil
+}
+
+//Deliver the changes made after the append of fromID, and every change
+//after, on the channel C of the subscription, which holds up to buffer
+//events. A slow consumer only falls behind, writers never wait for it.
+func (db *blackBearDB) Subscribe(fromID int64, buffer int) (*subscription, error) {
+	if err := db.rlock(context.Background()); err != nil {
+		return nil, err
+	}
+	f := db.feed
+	db.rwlock.RUnlock()
+	return subscribe(f, fromID, buffer)
 }
 
 //New Gob Writer. Create one for every thread doing writing
@@ -46,7 +234,7 @@ type blackBearGobWriter struct {
 
 func (db *blackBearDB) NewGobWriter() *blackBearGobWriter {
 	b := new(blackBearGobWriter)
-	b.w = SafeWriter{db.storage, 0}
+	b.w = SafeWriter{&db.tracker, 0}
 	b.e = gob.NewEncoder(&b.w) //Must be exactly points to b.w
 	b.db = db
 	return b
@@ -54,40 +242,63 @@ func (db *blackBearDB) NewGobWriter() *blackBearGobWriter {
 
 //Append item to the end of storage. Id and error(if any) is returned
 func (b *blackBearGobWriter) AddItem(item interface{}) (id int64, err error) {
-	b.db.rwlock.Lock()
+	return b.AddItemContext(context.Background(), item)
+}
+
+//Same as AddItem, giving up once ctx is done
+func (b *blackBearGobWriter) AddItemContext(ctx context.Context, item interface{}) (id int64, err error) {
+	if err = b.db.lock(ctx); err != nil {
+		return -1, err
+	}
 	defer b.db.rwlock.Unlock()
 
 	id = b.db.size()
+	if err = b.db.logChanges(feedRecord{id, id, EventAppend}); err != nil {
+		return -1, b.db.publish(0, err)
+	}
 	b.w.Offset = id
-	err = b.e.Encode(item)
-	return
+	if err = b.e.Encode(item); err != nil {
+		return id, b.db.publish(0, err)
+	}
+	return id, b.db.publish(1, nil)
 }
 
 //Append items to the end of storage. Id of first item and first error(if any)
 //encountered is returned
 func (b *blackBearGobWriter) AddItems(items ...interface{}) (id int64, err error) {
-	b.db.rwlock.Lock()
-	defer b.db.rwlock.Unlock()
+	return b.AddItemsContext(context.Background(), items...)
+}
 
-	id = b.db.size()
-	b.w.Offset = id
-	for _, item := range items {
-		err = b.e.Encode(item)
-		if err != nil {
-			break
-		}
+//Same as AddItems, giving up once ctx is done
+func (b *blackBearGobWriter) AddItemsContext(ctx context.Context, items ...interface{}) (id int64, err error) {
+	if err = b.db.lock(ctx); err != nil {
+		return -1, err
 	}
-	return
+	defer b.db.rwlock.Unlock()
+	return b.db.appendItems(&b.w, len(items), func(i int) error { return b.e.Encode(items[i]) })
 }
 
 //Modify item at id. The serialized size of item must be the same or less.
 //It could be very dangerous and is generally discoraged
 func (b *blackBearGobWriter) Modify(id int64, item interface{}) error {
-	b.db.rwlock.Lock()
+	return b.ModifyContext(context.Background(), id, item)
+}
+
+//Same as Modify, giving up once ctx is done
+func (b *blackBearGobWriter) ModifyContext(ctx context.Context, id int64, item interface{}) error {
+	if err := b.db.lock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.Unlock()
 
+	if err := b.db.logChanges(feedRecord{id, b.db.size(), EventModify}); err != nil {
+		return b.db.publish(0, err)
+	}
 	b.w.Offset = id
-	return b.e.Encode(item)
+	if err := b.e.Encode(item); err != nil {
+		return b.db.publish(0, err)
+	}
+	return b.db.publish(1, nil)
 }
 
 //Get the underlying DB
@@ -113,16 +324,34 @@ func (db *blackBearDB) NewGobReader() *blackBearGobReader {
 
 //Get item at id
 func (b *blackBearGobReader) GetItem(id int64, item interface{}) error {
-	b.db.rwlock.RLock()
+	return b.GetItemContext(context.Background(), id, item)
+}
+
+//Same as GetItem, giving up once ctx is done
+func (b *blackBearGobReader) GetItemContext(ctx context.Context, id int64, item interface{}) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
 	b.r.Offset = id
 	return b.d.Decode(item)
 }
 
 //Get items starting from id. If any error occur, the error is returned.
 func (b *blackBearGobReader) GetItems(id int64, items ...interface{}) error {
-	b.db.rwlock.RLock()
+	return b.GetItemsContext(context.Background(), id, items...)
+}
+
+//Same as GetItems, giving up once ctx is done
+func (b *blackBearGobReader) GetItemsContext(ctx context.Context, id int64, items ...interface{}) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
 	b.r.Offset = id
 	var err error = nil
 	for _, item := range items {
@@ -134,11 +363,72 @@ func (b *blackBearGobReader) GetItems(id int64, items ...interface{}) error {
 	return err
 }
 
+//Get the items at ids into items, reading ids close to each other together.
+//The error for every item is returned.
+func (b *blackBearGobReader) GetMany(ids []int64, items []interface{}) []error {
+	return b.GetManyContext(context.Background(), ids, items)
+}
+
+//Same as GetMany, giving up once ctx is done
+func (b *blackBearGobReader) GetManyContext(ctx context.Context, ids []int64, items []interface{}) []error {
+	if len(ids) != len(items) {
+		return batchErrors(len(ids), errBatchLength)
+	}
+	if err := b.db.rlock(ctx); err != nil {
+		return batchErrors(len(ids), err)
+	}
+	defer b.db.rwlock.RUnlock()
+	defer func() { b.r.ReaderAt = b.db.storage }()
+
+	errs := make([]error, len(ids))
+	order, readers := readBatch(readerContext(ctx, b.db.storage), b.db.size(), ids)
+	for _, i := range order { //Gob decodes in order
+		b.r.ReaderAt = readers[i]
+		b.r.Offset = ids[i]
+		errs[i] = b.d.Decode(items[i])
+	}
+	return errs
+}
+
 //Get the underlying DB
 func (b *blackBearGobReader) GetDB() *blackBearDB {
 	return b.db
 }
 
+//New Gob Tailer. Reads items one after another, waiting at the end for more
+//to be appended. All items from from on must have been written by the same
+//gob writer, and from must be the first item it wrote, as gob only sends
+//type information once.
+//=============================================================================
+type blackBearGobTailer struct {
+	r  SafeReader
+	d  *gob.Decoder
+	db *blackBearDB
+}
+
+func (db *blackBearDB) NewGobTailer(from int64) *blackBearGobTailer {
+	b := new(blackBearGobTailer)
+	b.r = SafeReader{db.storage, from}
+	b.d = gob.NewDecoder(&b.r) //Must be exactly points to b.r
+	b.db = db
+	return b
+}
+
+//Get the next item, waiting until it is appended or ctx is done
+func (b *blackBearGobTailer) Next(ctx context.Context, item interface{}) error {
+	return b.db.next(ctx, &b.r, func() error { return b.d.Decode(item) })
+}
+
+//Id of the next item
+func (b *blackBearGobTailer) Position() int64 {
+	return b.r.Offset
+}
+
+//Get the underlying DB
+func (b *blackBearGobTailer) GetDB() *blackBearDB {
+	return b.db
+}
+
 //New Serializer Writer. Create one for every thread doing writing
 //=============================================================================
 type blackBearSerializerWriter struct {
@@ -148,49 +438,70 @@ type blackBearSerializerWriter struct {
 
 func (db *blackBearDB) NewSerializerWriter() *blackBearSerializerWriter {
 	b := new(blackBearSerializerWriter)
-	b.w = SafeWriter{db.storage, 0}
+	b.w = SafeWriter{&db.tracker, 0}
 	b.db = db
 	return b
 }
 
 //Append item to the end of storage. Id and error(if any) is returned
 func (b *blackBearSerializerWriter) AddItem(item Serializer) (id int64, err error) {
-	b.db.rwlock.Lock()
+	return b.AddItemContext(context.Background(), item)
+}
+
+//Same as AddItem, giving up once ctx is done
+func (b *blackBearSerializerWriter) AddItemContext(ctx context.Context, item Serializer) (id int64, err error) {
+	if err = b.db.lock(ctx); err != nil {
+		return -1, err
+	}
 	defer b.db.rwlock.Unlock()
 
 	id = b.db.size()
+	if err = b.db.logChanges(feedRecord{id, id, EventAppend}); err != nil {
+		return -1, b.db.publish(0, err)
+	}
 	b.w.Offset = id
-	err = item.Serialize(&b.w)
-
-	return
+	if err = item.Serialize(&b.w); err != nil {
+		return id, b.db.publish(0, err)
+	}
+	return id, b.db.publish(1, nil)
 }
 
 //Append items to the end of storage. Id of first item and first error(if any)
 //encountered is returned
 func (b *blackBearSerializerWriter) AddItems(items ...Serializer) (id int64, err error) {
-	b.db.rwlock.Lock()
-	defer b.db.rwlock.Unlock()
+	return b.AddItemsContext(context.Background(), items...)
+}
 
-	id = b.db.size()
-	b.w.Offset = id
-	for _, item := range items {
-		err = item.Serialize(&b.w)
-		if err != nil {
-			break
-		}
+//Same as AddItems, giving up once ctx is done
+func (b *blackBearSerializerWriter) AddItemsContext(ctx context.Context, items ...Serializer) (id int64, err error) {
+	if err = b.db.lock(ctx); err != nil {
+		return -1, err
 	}
-
-	return
+	defer b.db.rwlock.Unlock()
+	return b.db.appendItems(&b.w, len(items), func(i int) error { return items[i].Serialize(&b.w) })
 }
 
 //Modify item at id. The serialized size of item must be the same or less.
 //It could be very dangerous and is generally discoraged
 func (b *blackBearSerializerWriter) Modify(id int64, item Serializer) error {
-	b.db.rwlock.Lock()
+	return b.ModifyContext(context.Background(), id, item)
+}
+
+//Same as Modify, giving up once ctx is done
+func (b *blackBearSerializerWriter) ModifyContext(ctx context.Context, id int64, item Serializer) error {
+	if err := b.db.lock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.Unlock()
 
+	if err := b.db.logChanges(feedRecord{id, b.db.size(), EventModify}); err != nil {
+		return b.db.publish(0, err)
+	}
 	b.w.Offset = id
-	return item.Serialize(&b.w)
+	if err := item.Serialize(&b.w); err != nil {
+		return b.db.publish(0, err)
+	}
+	return b.db.publish(1, nil)
 }
 
 //Get the underlying DB
@@ -214,8 +525,17 @@ func (db *blackBearDB) NewSerializerReader() *blackBearSerializerReader {
 
 //Get item at id
 func (b *blackBearSerializerReader) GetItem(id int64, item Serializer) error {
-	b.db.rwlock.RLock()
+	return b.GetItemContext(context.Background(), id, item)
+}
+
+//Same as GetItem, giving up once ctx is done
+func (b *blackBearSerializerReader) GetItemContext(ctx context.Context, id int64, item Serializer) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
 
 	b.r.Offset = id
 	return item.Deserialize(&b.r)
@@ -223,8 +543,17 @@ func (b *blackBearSerializerReader) GetItem(id int64, item Serializer) error {
 
 //Get items starting from id. If any error occur, the error is returned.
 func (b *blackBearSerializerReader) GetItems(id int64, items ...Serializer) error {
-	b.db.rwlock.RLock()
+	return b.GetItemsContext(context.Background(), id, items...)
+}
+
+//Same as GetItems, giving up once ctx is done
+func (b *blackBearSerializerReader) GetItemsContext(ctx context.Context, id int64, items ...Serializer) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
 
 	b.r.Offset = id
 	var err error = nil
@@ -237,9 +566,63 @@ func (b *blackBearSerializerReader) GetItems(id int64, items ...Serializer) erro
 	return err
 }
 
+//Get the items at ids into items, reading ids close to each other together
+//and decoding on all processors. The error for every item is returned.
+func (b *blackBearSerializerReader) GetMany(ids []int64, items []Serializer) []error {
+	return b.GetManyContext(context.Background(), ids, items)
+}
+
+//Same as GetMany, giving up once ctx is done
+func (b *blackBearSerializerReader) GetManyContext(ctx context.Context, ids []int64, items []Serializer) []error {
+	if len(ids) != len(items) {
+		return batchErrors(len(ids), errBatchLength)
+	}
+	if err := b.db.rlock(ctx); err != nil {
+		return batchErrors(len(ids), err)
+	}
+	defer b.db.rwlock.RUnlock()
+
+	errs := make([]error, len(ids))
+	_, readers := readBatch(readerContext(ctx, b.db.storage), b.db.size(), ids)
+	decodeParallel(len(ids), func(i int) {
+		errs[i] = items[i].Deserialize(&SafeReader{readers[i], ids[i]})
+	})
+	return errs
+}
+
 //Get the underlying DB
 func (b *blackBearSerializerReader) GetDB() *blackBearDB {
 	return b.db
 }
 
+//New Serializer Tailer. Reads items one after another, waiting at the end for
+//more to be appended.
+//=============================================================================
+type blackBearSerializerTailer struct {
+	r  SafeReader
+	db *blackBearDB
+}
+
+func (db *blackBearDB) NewSerializerTailer(from int64) *blackBearSerializerTailer {
+	b := new(blackBearSerializerTailer)
+	b.r = SafeReader{db.storage, from}
+	b.db = db
+	return b
+}
+
+//Get the next item, waiting until it is appended or ctx is done
+func (b *blackBearSerializerTailer) Next(ctx context.Context, item Serializer) error {
+	return b.db.next(ctx, &b.r, func() error { return item.Deserialize(&b.r) })
+}
+
+//Id of the next item
+func (b *blackBearSerializerTailer) Position() int64 {
+	return b.r.Offset
+}
+
+//Get the underlying DB
+func (b *blackBearSerializerTailer) GetDB() *blackBearDB {
+	return b.db
+}
+
 //=============================================================================
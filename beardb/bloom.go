@@ -0,0 +1,89 @@
+package beardb
+
+import (
+	"math"
+)
+
+//Bloom filters
+/*=============================================================================
+A Bloom filter tells for sure that a key was never added to it, so a lookup
+for a missing key need not read the storage at all. A key is added by setting
+hashes bits picked by double hashing, and may be there only if all of them
+are set. Keys are never taken out, so a filter only gets fuller until it is
+built again.
+
+For a false positive rate p, a filter takes -ln(p)/ln(2)^2 bits and
+ln(2) times that many hashes per key.
+=============================================================================*/
+const defaultFalsePositiveRate = 0.01
+
+type bloomFilter struct {
+	off    int64 //Where the bits are in the storage
+	hashes uint32
+	bits   []byte
+}
+
+//Length in bytes and number of hashes of a filter for keys keys at rate
+func bloomSize(keys int64, rate float64) (int64, uint32) {
+	perKey := -math.Log(rate) / (math.Ln2 * math.Ln2)
+	length := int64(math.Ceil(float64(keys)*perKey/8)) + 1
+	hashes := uint32(math.Round(perKey * math.Ln2))
+	if hashes == 0 {
+		hashes = 1
+	}
+	return length, hashes
+}
+
+//Two hashes from the hash of a key, mixed so they do not follow the buckets
+func bloomHashes(k uint64) (uint64, uint64) {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k, k>>32 | 1
+}
+
+//Call f with the byte and bit of each of the hashes of a key hashing to k,
+//stopping if it returns false
+func (f *bloomFilter) each(k uint64, do func(i int, bit byte) bool) {
+	h1, h2 := bloomHashes(k)
+	m := uint64(len(f.bits)) * 8
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		b := (h1 + i*h2) % m
+		if !do(int(b/8), 1<<(b%8)) {
+			return
+		}
+	}
+}
+
+//Whether a key hashing to k may have been added
+func (f *bloomFilter) mayContain(k uint64) bool {
+	found := true
+	f.each(k, func(i int, bit byte) bool {
+		found = f.bits[i]&bit != 0
+		return found
+	})
+	return found
+}
+
+//Add a key hashing to k, writing the bytes changed to s
+func (f *bloomFilter) add(s BearStorage, k uint64) error {
+	var err error
+	f.each(k, func(i int, bit byte) bool {
+		if f.bits[i]&bit == 0 {
+			f.bits[i] |= bit
+			_, err = s.WriteAt(f.bits[i:i+1], f.off+int64(i))
+		}
+		return err == nil
+	})
+	return err
+}
+
+//Add a key hashing to k in memory only
+func (f *bloomFilter) set(k uint64) {
+	f.each(k, func(i int, bit byte) bool {
+		f.bits[i] |= bit
+		return true
+	})
+}
@@ -2,10 +2,11 @@ package beardb
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"io"
-	"sync"
 )
 
 //Data Structures
@@ -50,8 +51,12 @@ const (
 	datainfoLength     = 4
 	chunkinfoLength    = 1
 	blockinfoLength    = 4
+	maxEntryLength     = 1<<30 - 1
+	minEntryLength     = 8 //Room for the pointer of a LongJump
 )
 
+var ErrDeleted = errors.New("Item has been deleted")
+
 //(Deleted flag bit)(LongJump flag bit)(30-bits unsigned int of length)
 type datainfo uint32
 
@@ -105,7 +110,18 @@ func (d *datainfo) ReadFrom(r io.Reader) error {
 //=============================================================================
 type brownBearDB struct {
 	storage BearStorage
-	rwlock  sync.RWMutex //Appending lock
+	tracker tracker //All writes go through it
+	rwlock  rwMutex //Appending lock
+	feed    *feed   //Changes are recorded here, nil if not enabled
+	wal     *wal    //Transactions are logged here, nil if not set
+
+	versioned bool             //Entries keep their versions
+	retain    int              //Versions kept before the latest, 0 for all
+	indexes   []secondaryIndex //Indexes kept with the entries
+
+	snapshots map[*brownBearSnapshot]bool //Open snapshots
+	versions  map[int64][]version         //Copies kept for them, by id
+	seq       int64                       //Changes copied so far
 }
 
 //Non-locking getting size
@@ -113,11 +129,36 @@ func (db *brownBearDB) size() int64 {
 	return db.storage.Size()
 }
 
+//Durably log changes in the feed, if any, before they are made. Must hold
+//the write lock.
+func (db *brownBearDB) logChanges(records ...feedRecord) error {
+	if db.feed == nil {
+		return nil
+	}
+	return db.feed.log(records...)
+}
+
+//Deliver the first n changes logged in the feed, if any, dropping the rest.
+//Must hold the write lock.
+func (db *brownBearDB) publish(n int) error {
+	if db.feed == nil {
+		return nil
+	}
+	return db.feed.publish(n)
+}
+
+//Whether single changes go through commit, which works them out on a shadow
+//before making them, as the indexes and the feed need. Must hold the write
+//lock.
+func (db *brownBearDB) viaCommit() bool {
+	return len(db.indexes) > 0 || db.feed != nil
+}
+
 //Public methods
 //=============================================================================
 //Constructor
 func NewBrownBearDB(s BearStorage) *brownBearDB {
-	return &brownBearDB{storage: s}
+	return &brownBearDB{storage: s, tracker: tracker{BearStorage: s}}
 }
 
 //Get current size
@@ -127,16 +168,353 @@ func (db *brownBearDB) Size() int64 {
 	return db.size()
 }
 
-//Make sure to close it before exit! Better use defer.
+//Wait for running operations, then sync and close the storage. Later
+//operations fail with ErrClosed, and closing again does nothing. Make sure
+//to close it before exit! Better use defer.
 func (db *brownBearDB) Close() error {
-	return db.storage.Close()
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if db.tracker.closed {
+		return nil
+	}
+	db.tracker.close()
+	var err error
+	if db.feed != nil {
+		err = db.feed.close()
+	}
+	if serr := syncStorage(db.storage); err == nil {
+		err = serr
+	}
+	if cerr := db.storage.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//Take the write lock of an open database, giving up once ctx is done. A
+//transaction left pending by a failure is made first.
+func (db *brownBearDB) lock(ctx context.Context) error {
+	if err := lockOpen(ctx, &db.rwlock, &db.tracker); err != nil {
+		return err
+	}
+	if db.wal != nil && db.wal.logged != nil {
+		if err := db.redo(); err != nil {
+			db.rwlock.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+//Take the read lock of an open database, giving up once ctx is done. A
+//transaction left pending by a failure is made first, so it is never seen
+//half made.
+func (db *brownBearDB) rlock(ctx context.Context) error {
+	for {
+		if err := lockOpen(ctx, db.rwlock.RLocker(), &db.tracker); err != nil {
+			return err
+		}
+		if db.wal == nil || db.wal.logged == nil {
+			return nil
+		}
+		db.rwlock.RUnlock()
+		if err := db.lock(ctx); err != nil {
+			return err
+		}
+		db.rwlock.Unlock()
+	}
+}
+
+//Write a checkpoint of a koala-backed database to path in the background.
+//Writers are only blocked while taking the image. The returned channel
+//delivers the result. Restore with koala.FromFile.
+func (db *brownBearDB) Checkpoint(path string) <-chan error {
+	return checkpoint(db.rwlock.RLocker(), &db.tracker, path)
+}
+
+//Write a consistent backup of the database into w while it stays in use.
+//Restore with RestoreBackup.
+func (db *brownBearDB) Backup(w io.Writer) error {
+	return backup(&db.rwlock, &db.tracker, w)
+}
+
+//Copy a consistent image of the database into dst while it stays in use.
+//Dst can be opened as a database directly.
+func (db *brownBearDB) BackupTo(dst BearStorage) error {
+	return backupTo(&db.rwlock, &db.tracker, dst)
+}
+
+//Make the database a primary, keeping the latest retain writes in memory for
+//followers to catch up from. Serve followers with primary.Serve.
+func (db *brownBearDB) NewPrimary(retain int) (*primary, error) {
+	return newPrimary(&db.rwlock, &db.tracker, retain)
+}
+
+//Make the database a follower, resuming from a saved position or starting
+//from the zero Position. Connect it to the primary with follower.Run. An
+//image of the primary is received into scratch, a temporary storage, before
+//it replaces the content of the bear. With scratch nil it is kept in memory.
+func (db *brownBearDB) NewFollower(from Position, scratch BearStorage) *follower {
+	return newFollower(&db.rwlock, &db.tracker, from, scratch)
+}
+
+//Record every change from now on in s, which keeps the feed across restarts.
+//Enable it before any writing to have every entry in it.
+func (db *brownBearDB) EnableFeed(s BearStorage) error {
+	if err := db.lock(context.Background()); err != nil {
+		return err
+	}
+	defer db.rwlock.Unlock()
+	if db.feed != nil {
+		return errors.New("Feed already enabled")
+	}
+	f, err := newFeed(s)
+	if err != nil {
+		return err
+	}
+	db.feed = f
+	return nil
+}
+
+//Deliver the changes made after the append of fromID, and every change
+//after, on the channel C of the subscription, which holds up to buffer
+//events. A slow consumer only falls behind, writers never wait for it.
+func (db *brownBearDB) Subscribe(fromID int64, buffer int) (*subscription, error) {
+	if err := db.rlock(context.Background()); err != nil {
+		return nil, err
+	}
+	f := db.feed
+	db.rwlock.RUnlock()
+	return subscribe(f, fromID, buffer)
+}
+
+//Delete the entry at id. Its space is not reused.
+func (db *brownBearDB) Delete(id int64) error {
+	return db.DeleteContext(context.Background(), id)
+}
+
+//Same as Delete, giving up once ctx is done
+func (db *brownBearDB) DeleteContext(ctx context.Context, id int64) error {
+	if err := db.lock(ctx); err != nil {
+		return err
+	}
+	defer db.rwlock.Unlock()
+
+	if db.viaCommit() {
+		_, err := db.commit([]txOp{{kind: EventDelete, id: id}})
+		return err
+	}
+	loc, err := db.preserve(&db.tracker, id)
+	if err != nil {
+		return err
+	}
+	if _, err = deleteEntry(&db.tracker, id); err != nil {
+		return err
+	}
+	db.keep(id, loc)
+	return nil
+}
+
+//Append data as an entry. Must hold the write lock.
+func (db *brownBearDB) add(data []byte) (int64, error) {
+	if db.viaCommit() {
+		ids, err := db.commit([]txOp{{kind: EventAppend, data: data}})
+		if err != nil {
+			return -1, err
+		}
+		return ids[0], nil
+	}
+	id, _, err := db.appendTo(&db.tracker, data)
+	return id, err
+}
+
+//Put data into the entry at id. Must hold the write lock.
+func (db *brownBearDB) modify(id int64, data []byte) error {
+	if db.viaCommit() {
+		_, err := db.commit([]txOp{{kind: EventModify, id: id, data: data}})
+		return err
+	}
+	loc, err := db.preserve(&db.tracker, id)
+	if err != nil {
+		return err
+	}
+	if _, err = db.modifyIn(&db.tracker, id, data); err != nil {
+		return err
+	}
+	db.keep(id, loc)
+	return nil
+}
+
+//Append data as an entry in s, in the mode of the database
+func (db *brownBearDB) appendTo(s BearStorage, data []byte) (int64, feedRecord, error) {
+	if db.versioned {
+		return appendVersioned(s, data)
+	}
+	return appendEntry(s, data)
+}
+
+//Put data into the entry at id in s, in the mode of the database
+func (db *brownBearDB) modifyIn(s BearStorage, id int64, data []byte) (feedRecord, error) {
+	if db.versioned {
+		return modifyVersioned(s, id, data, db.retain)
+	}
+	return modifyEntry(s, id, data)
+}
+
+//Data of the entry at id in s, with the padding after it if any
+func (db *brownBearDB) entryData(s BearStorage, id int64) ([]byte, error) {
+	r := &SafeReader{s, id}
+	if err := db.seek(nil, r, id); err != nil {
+		return nil, err
+	}
+	skip := int64(0)
+	if db.versioned {
+		skip = versionHeaderLength
+	}
+	info := new(datainfo)
+	if err := info.ReadFrom(&SafeReader{s, r.Offset - datainfoLength - skip}); err != nil {
+		return nil, err
+	}
+	data := make([]byte, int64(info.GetLength())-skip)
+	if _, err := s.ReadAt(data, r.Offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//Entry operations
+/*=============================================================================
+They work on any BearStorage, so a transaction can run them on a shadow of
+the storage first, and return the change to record in the feed.
+=============================================================================*/
+//Append an entry holding data to s
+func appendEntry(s BearStorage, data []byte) (int64, feedRecord, error) {
+	if len(data) > maxEntryLength {
+		return -1, feedRecord{}, errors.New("Item is too large")
+	}
+	id := s.Size()
+	length := len(data)
+	if length < minEntryLength { //Decoders ignore the padding
+		length = minEntryLength
+	}
+	entry := make([]byte, datainfoLength+length)
+	binary.LittleEndian.PutUint32(entry, uint32(*newDataInfo(length)))
+	copy(entry[datainfoLength:], data)
+	if _, err := s.WriteAt(entry, id); err != nil {
+		return -1, feedRecord{}, err
+	}
+	return id, feedRecord{id, id, EventAppend}, nil
+}
+
+//Put data into the entry at id, in place if it fits, or else in a new area
+//the entry jumps to
+func modifyEntry(s BearStorage, id int64, data []byte) (feedRecord, error) {
+	if len(data) > maxEntryLength {
+		return feedRecord{}, errors.New("Item is too large")
+	}
+	tail := s.Size()
+	rw := &SafeReadWriter{s, id}
+	oldinfo := new(datainfo)
+	if err := oldinfo.ReadFrom(rw); err != nil {
+		return feedRecord{}, err
+	}
+	if oldinfo.IsDeleted() {
+		return feedRecord{}, ErrDeleted
+	}
+	r := feedRecord{id, tail, EventModify}
+
+	if len(data) <= oldinfo.GetLength() { //Can fit
+		info := newDataInfo(oldinfo.GetLength())
+		rw.Offset = id
+		if err := info.WriteTo(rw); err != nil {
+			return r, err
+		}
+		_, err := rw.Write(data)
+		return r, err
+	}
+	if oldinfo.IsLongJump() {
+		newid := new(Int64)
+		if err := newid.Deserialize(rw); err != nil {
+			return r, err
+		}
+		rw.Offset = newid.Get()
+		jumpedinfo := new(datainfo)
+		if err := jumpedinfo.ReadFrom(rw); err != nil {
+			return r, err
+		}
+		if len(data) <= jumpedinfo.GetLength() { //Can fit
+			_, err := rw.Write(data)
+			return r, err
+		}
+	}
+	//Allocate a new area for LongJump, marked deleted so a scan does not take
+	//it for an entry. Only its length is read after a LongJump.
+	newid, _, err := appendEntry(s, data)
+	if err != nil {
+		return r, err
+	}
+	area := new(datainfo)
+	rw.Offset = newid
+	if err = area.ReadFrom(rw); err != nil {
+		return r, err
+	}
+	area.SetDeleted(true)
+	rw.Offset = newid
+	if err = area.WriteTo(rw); err != nil {
+		return r, err
+	}
+	//Set LongJump
+	oldinfo.SetLongJump(true)
+	rw.Offset = id
+	if err := oldinfo.WriteTo(rw); err != nil {
+		return r, err
+	}
+	return r, NewInt64(newid).Serialize(rw)
+}
+
+//Mark the entry at id deleted
+func deleteEntry(s BearStorage, id int64) (feedRecord, error) {
+	rw := &SafeReadWriter{s, id}
+	info := new(datainfo)
+	if err := info.ReadFrom(rw); err != nil {
+		return feedRecord{}, err
+	}
+	if info.IsDeleted() {
+		return feedRecord{}, ErrDeleted
+	}
+	info.SetDeleted(true)
+	rw.Offset = id
+	if err := info.WriteTo(rw); err != nil {
+		return feedRecord{}, err
+	}
+	return feedRecord{id, s.Size(), EventDelete}, nil
+}
+
+//Move r to the data of the entry at id, skipping skip bytes after the
+//datainfo a LongJump goes to
+func seekEntry(r *SafeReader, id int64, skip int64) error {
+	info := new(datainfo)
+	r.Offset = id
+	if err := info.ReadFrom(r); err != nil {
+		return err
+	}
+	if info.IsDeleted() {
+		return ErrDeleted
+	}
+	if info.IsLongJump() {
+		newid := new(Int64)
+		if err := newid.Deserialize(r); err != nil {
+			return err
+		}
+		r.Offset = newid.Get() + datainfoLength + skip
+	}
+	return nil
 }
 
 //New Gob Writer. Create one for every thread doing writing
 //=============================================================================
 type brownBearGobWriter struct {
 	buff *bytes.Buffer
-	w    *SafeReadWriter
 	e    *gob.Encoder
 	db   *brownBearDB
 }
@@ -144,95 +522,91 @@ type brownBearGobWriter struct {
 func (db *brownBearDB) NewGobWriter() *brownBearGobWriter {
 	b := new(brownBearGobWriter)
 	b.buff = new(bytes.Buffer)
-	b.w = &SafeReadWriter{db.storage, 0}
 	b.e = gob.NewEncoder(b.buff)
 	b.db = db
 	return b
 }
 
+//Encode items into a new slice. With alone, type information is sent again
+//so that the slice can be decoded on its own.
+func (b *brownBearGobWriter) encode(alone bool, items ...interface{}) ([]byte, error) {
+	defer b.buff.Reset()
+	e := b.e
+	if alone {
+		e = gob.NewEncoder(b.buff)
+	}
+	for _, item := range items {
+		if err := e.Encode(item); err != nil {
+			return nil, err
+		}
+	}
+	return append([]byte(nil), b.buff.Bytes()...), nil
+}
+
 //Append item to the end of storage. Id and error(if any) is returned
 func (b *brownBearGobWriter) AddItem(item interface{}) (id int64, err error) {
-	err = b.e.Encode(item)
-	info := newDataInfo(b.buff.Len())
-
-	b.db.rwlock.Lock()
-	defer b.db.rwlock.Unlock()
-
-	id = b.db.size()
-	b.w.Offset = id
-	info.WriteTo(b.w)
-	b.buff.WriteTo(b.w)
+	return b.AddItemContext(context.Background(), item)
+}
 
-	return
+//Same as AddItem, giving up once ctx is done
+func (b *brownBearGobWriter) AddItemContext(ctx context.Context, item interface{}) (id int64, err error) {
+	return b.AddItemsContext(ctx, item)
 }
 
 //Append items to the end of storage. Id of first item and first error(if any)
 //encountered is returned
 func (b *brownBearGobWriter) AddItems(items ...interface{}) (id int64, err error) {
-	for _, item := range items {
-		err = b.e.Encode(item)
-		if err != nil {
-			return -1, err
-		}
-	}
-	info := newDataInfo(b.buff.Len())
+	return b.AddItemsContext(context.Background(), items...)
+}
 
-	b.db.rwlock.Lock()
+//Same as AddItems, giving up once ctx is done
+func (b *brownBearGobWriter) AddItemsContext(ctx context.Context, items ...interface{}) (id int64, err error) {
+	if err = b.db.lock(ctx); err != nil {
+		return -1, err
+	}
 	defer b.db.rwlock.Unlock()
-
-	id = b.db.size()
-	b.w.Offset = id
-	info.WriteTo(b.w)
-	b.buff.WriteTo(b.w)
-	return
+	data, err := b.encode(b.db.indexed(), items...)
+	if err != nil {
+		return -1, err
+	}
+	return b.db.add(data)
 }
 
 //Modify items at id
 func (b *brownBearGobWriter) Modify(id int64, items ...interface{}) error {
-	var err error
-	for _, item := range items {
-		err = b.e.Encode(item)
-		if err != nil {
-			return err
-		}
-	}
-	oldinfo := new(datainfo)
-	b.w.Offset = id
-	oldinfo.ReadFrom(b.w)
+	return b.ModifyContext(context.Background(), id, items...)
+}
 
-	b.db.rwlock.Lock()
+//Same as Modify, giving up once ctx is done
+func (b *brownBearGobWriter) ModifyContext(ctx context.Context, id int64, items ...interface{}) error {
+	if err := b.db.lock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.Unlock()
-	if b.buff.Len() <= oldinfo.GetLength() { //Can fit
-		info := newDataInfo(oldinfo.GetLength())
-		b.w.Offset = id
-		info.WriteTo(b.w)
-		b.buff.WriteTo(b.w)
-	} else {
-		if oldinfo.IsLongJump() {
-			newid := new(Int64)
-			newid.Deserialize(b.w)
-			b.w.Offset = newid.Get()
-			jumpedinfo := new(datainfo)
-			jumpedinfo.ReadFrom(b.w)
-			if b.buff.Len() <= jumpedinfo.GetLength() { //Can fit
-				b.buff.WriteTo(b.w)
-				return err
-			}
-		} else { //Allocate a new area for LongJump
-			newid := b.db.size()
-			info := newDataInfo(b.buff.Len())
-			b.w.Offset = newid
-			info.WriteTo(b.w)
-			b.buff.WriteTo(b.w)
-			//Set LongJump
-			oldinfo.SetLongJump(true)
-			b.w.Offset = id
-			oldinfo.WriteTo(b.w)
-			NewInt64(newid).Serialize(b.w)
-		}
+	data, err := b.encode(b.db.indexed(), items...)
+	if err != nil {
+		return err
 	}
+	return b.db.modify(id, data)
+}
 
-	return err
+//Append items as one entry when tx commits. Indexes may be added before it
+//does, so the items are encoded to be decoded on their own.
+func (b *brownBearGobWriter) AddItemsTx(tx *brownBearTx, items ...interface{}) error {
+	data, err := b.encode(true, items...)
+	if err != nil {
+		return err
+	}
+	return tx.add(data)
+}
+
+//Modify items at id when tx commits, encoded as by AddItemsTx
+func (b *brownBearGobWriter) ModifyTx(tx *brownBearTx, id int64, items ...interface{}) error {
+	data, err := b.encode(true, items...)
+	if err != nil {
+		return err
+	}
+	return tx.modify(id, data)
 }
 
 //Get the underlying DB
@@ -243,9 +617,10 @@ func (b *brownBearGobWriter) GetDB() *brownBearDB {
 //New Gob Reader. Create one for every thread doing reading
 //=============================================================================
 type brownBearGobReader struct {
-	r  *SafeReader
-	d  *gob.Decoder
-	db *brownBearDB
+	r    *SafeReader
+	d    *gob.Decoder
+	snap *brownBearSnapshot //Nil to read the latest
+	db   *brownBearDB
 }
 
 func (db *brownBearDB) NewGobReader() *brownBearGobReader {
@@ -256,39 +631,254 @@ func (db *brownBearDB) NewGobReader() *brownBearGobReader {
 	return b
 }
 
+//Decode items from the offset of b.r. Entries written to a bear with indexes
+//send type information again, which b.d refuses if it has it already, so
+//they are decoded again by a new decoder.
+func (b *brownBearGobReader) decode(items ...interface{}) error {
+	off := b.r.Offset
+	err := decodeGob(b.d, items)
+	if err != nil && err.Error() == errGobDuplicateType {
+		b.r.Offset = off
+		err = decodeGob(gob.NewDecoder(b.r), items)
+	}
+	return err
+}
+
 //Get item at id
 func (b *brownBearGobReader) GetItem(id int64, item interface{}) error {
-	b.db.rwlock.RLock()
+	return b.GetItemContext(context.Background(), id, item)
+}
+
+//Same as GetItem, giving up once ctx is done
+func (b *brownBearGobReader) GetItemContext(ctx context.Context, id int64, item interface{}) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
 
-	info := new(datainfo)
-	b.r.Offset = id
-	info.ReadFrom(b.r)
-	if info.IsLongJump() {
-		newid := new(Int64)
-		newid.Deserialize(b.r)
-		b.r.Offset = newid.Get() + datainfoLength
+	if err := b.db.seek(b.snap, b.r, id); err != nil {
+		return err
 	}
-	return b.d.Decode(item)
+	return b.decode(item)
 }
 
 //Get items starting from id. If any error occur, the error is returned.
 func (b *brownBearGobReader) GetItems(id int64, items ...interface{}) error {
-	b.db.rwlock.RLock()
+	return b.GetItemsContext(context.Background(), id, items...)
+}
+
+//Same as GetItems, giving up once ctx is done
+func (b *brownBearGobReader) GetItemsContext(ctx context.Context, id int64, items ...interface{}) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
 	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
 
-	info := new(datainfo)
-	b.r.Offset = id
-	info.ReadFrom(b.r)
-	if info.IsLongJump() {
-		newid := new(Int64)
-		newid.Deserialize(b.r)
-		b.r.Offset = newid.Get() + datainfoLength
+	if err := b.db.seek(b.snap, b.r, id); err != nil {
+		return err
+	}
+	return b.decode(items...)
+}
+
+//Get version v of the item at id. The database must be versioned.
+func (b *brownBearGobReader) GetItemAt(id int64, v uint32, item interface{}) error {
+	return b.GetItemAtContext(context.Background(), id, v, item)
+}
+
+//Same as GetItemAt, giving up once ctx is done
+func (b *brownBearGobReader) GetItemAtContext(ctx context.Context, id int64, v uint32, item interface{}) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
+	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
+
+	loc, err := b.db.findVersion(id, v)
+	if err != nil {
+		return err
+	}
+	b.r.Offset = loc + datainfoLength + versionHeaderLength
+	return b.decode(item)
+}
+
+//Get the items at ids into items, reading ids close to each other together.
+//The error for every item is returned.
+func (b *brownBearGobReader) GetMany(ids []int64, items []interface{}) []error {
+	return b.GetManyContext(context.Background(), ids, items)
+}
+
+//Same as GetMany, giving up once ctx is done
+func (b *brownBearGobReader) GetManyContext(ctx context.Context, ids []int64, items []interface{}) []error {
+	if len(ids) != len(items) {
+		return batchErrors(len(ids), errBatchLength)
+	}
+	if err := b.db.rlock(ctx); err != nil {
+		return batchErrors(len(ids), err)
+	}
+	defer b.db.rwlock.RUnlock()
+	defer func() { b.r.ReaderAt = b.db.storage }()
+
+	errs := make([]error, len(ids))
+	order, readers := readBatch(readerContext(ctx, b.db.storage), b.db.size(), ids)
+	for _, i := range order { //Gob decodes in order
+		b.r.ReaderAt = readers[i]
+		if errs[i] = b.db.seek(b.snap, b.r, ids[i]); errs[i] == nil {
+			errs[i] = b.decode(items[i])
+		}
+	}
+	return errs
+}
+
+//Get the underlying DB
+func (b *brownBearGobReader) GetDB() *brownBearDB {
+	return b.db
+}
+
+//New Serializer Writer. Create one for every thread doing writing
+//=============================================================================
+type brownBearSerializerWriter struct {
+	buff *bytes.Buffer
+	db   *brownBearDB
+}
+
+func (db *brownBearDB) NewSerializerWriter() *brownBearSerializerWriter {
+	b := new(brownBearSerializerWriter)
+	b.buff = new(bytes.Buffer)
+	b.db = db
+	return b
+}
+
+//Serialize items into a new slice
+func (b *brownBearSerializerWriter) encode(items ...Serializer) ([]byte, error) {
+	defer b.buff.Reset()
+	for _, item := range items {
+		if err := item.Serialize(b.buff); err != nil {
+			return nil, err
+		}
 	}
+	return append([]byte(nil), b.buff.Bytes()...), nil
+}
+
+//Append item to the end of storage. Id and error(if any) is returned
+func (b *brownBearSerializerWriter) AddItem(item Serializer) (id int64, err error) {
+	return b.AddItemContext(context.Background(), item)
+}
+
+//Same as AddItem, giving up once ctx is done
+func (b *brownBearSerializerWriter) AddItemContext(ctx context.Context, item Serializer) (id int64, err error) {
+	return b.AddItemsContext(ctx, item)
+}
+
+//Append items to the end of storage. Id of first item and first error(if any)
+//encountered is returned
+func (b *brownBearSerializerWriter) AddItems(items ...Serializer) (id int64, err error) {
+	return b.AddItemsContext(context.Background(), items...)
+}
+
+//Same as AddItems, giving up once ctx is done
+func (b *brownBearSerializerWriter) AddItemsContext(ctx context.Context, items ...Serializer) (id int64, err error) {
+	data, err := b.encode(items...)
+	if err != nil {
+		return -1, err
+	}
+	if err = b.db.lock(ctx); err != nil {
+		return -1, err
+	}
+	defer b.db.rwlock.Unlock()
+	return b.db.add(data)
+}
+
+//Modify items at id
+func (b *brownBearSerializerWriter) Modify(id int64, items ...Serializer) error {
+	return b.ModifyContext(context.Background(), id, items...)
+}
 
+//Same as Modify, giving up once ctx is done
+func (b *brownBearSerializerWriter) ModifyContext(ctx context.Context, id int64, items ...Serializer) error {
+	data, err := b.encode(items...)
+	if err != nil {
+		return err
+	}
+	if err = b.db.lock(ctx); err != nil {
+		return err
+	}
+	defer b.db.rwlock.Unlock()
+	return b.db.modify(id, data)
+}
+
+//Append items as one entry when tx commits
+func (b *brownBearSerializerWriter) AddItemsTx(tx *brownBearTx, items ...Serializer) error {
+	data, err := b.encode(items...)
+	if err != nil {
+		return err
+	}
+	return tx.add(data)
+}
+
+//Modify items at id when tx commits
+func (b *brownBearSerializerWriter) ModifyTx(tx *brownBearTx, id int64, items ...Serializer) error {
+	data, err := b.encode(items...)
+	if err != nil {
+		return err
+	}
+	return tx.modify(id, data)
+}
+
+//Get the underlying DB
+func (b *brownBearSerializerWriter) GetDB() *brownBearDB {
+	return b.db
+}
+
+//New Serializer Reader. Create one for every thread doing reading
+//=============================================================================
+type brownBearSerializerReader struct {
+	r    SafeReader
+	snap *brownBearSnapshot //Nil to read the latest
+	db   *brownBearDB
+}
+
+func (db *brownBearDB) NewSerializerReader() *brownBearSerializerReader {
+	b := new(brownBearSerializerReader)
+	b.r = SafeReader{db.storage, 0}
+	b.db = db
+	return b
+}
+
+//Get item at id
+func (b *brownBearSerializerReader) GetItem(id int64, item Serializer) error {
+	return b.GetItemContext(context.Background(), id, item)
+}
+
+//Same as GetItem, giving up once ctx is done
+func (b *brownBearSerializerReader) GetItemContext(ctx context.Context, id int64, item Serializer) error {
+	return b.GetItemsContext(ctx, id, item)
+}
+
+//Get items starting from id. If any error occur, the error is returned.
+func (b *brownBearSerializerReader) GetItems(id int64, items ...Serializer) error {
+	return b.GetItemsContext(context.Background(), id, items...)
+}
+
+//Same as GetItems, giving up once ctx is done
+func (b *brownBearSerializerReader) GetItemsContext(ctx context.Context, id int64, items ...Serializer) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
+	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
+
+	if err := b.db.seek(b.snap, &b.r, id); err != nil {
+		return err
+	}
 	var err error = nil
 	for _, item := range items {
-		err = b.d.Decode(item)
+		err = item.Deserialize(&b.r)
 		if err != nil {
 			break
 		}
@@ -296,8 +886,57 @@ func (b *brownBearGobReader) GetItems(id int64, items ...interface{}) error {
 	return err
 }
 
+//Get version v of the item at id. The database must be versioned.
+func (b *brownBearSerializerReader) GetItemAt(id int64, v uint32, item Serializer) error {
+	return b.GetItemAtContext(context.Background(), id, v, item)
+}
+
+//Same as GetItemAt, giving up once ctx is done
+func (b *brownBearSerializerReader) GetItemAtContext(ctx context.Context, id int64, v uint32, item Serializer) error {
+	if err := b.db.rlock(ctx); err != nil {
+		return err
+	}
+	defer b.db.rwlock.RUnlock()
+	b.r.ReaderAt = readerContext(ctx, b.db.storage)
+	defer func() { b.r.ReaderAt = b.db.storage }()
+
+	loc, err := b.db.findVersion(id, v)
+	if err != nil {
+		return err
+	}
+	b.r.Offset = loc + datainfoLength + versionHeaderLength
+	return item.Deserialize(&b.r)
+}
+
+//Get the items at ids into items, reading ids close to each other together
+//and decoding on all processors. The error for every item is returned.
+func (b *brownBearSerializerReader) GetMany(ids []int64, items []Serializer) []error {
+	return b.GetManyContext(context.Background(), ids, items)
+}
+
+//Same as GetMany, giving up once ctx is done
+func (b *brownBearSerializerReader) GetManyContext(ctx context.Context, ids []int64, items []Serializer) []error {
+	if len(ids) != len(items) {
+		return batchErrors(len(ids), errBatchLength)
+	}
+	if err := b.db.rlock(ctx); err != nil {
+		return batchErrors(len(ids), err)
+	}
+	defer b.db.rwlock.RUnlock()
+
+	errs := make([]error, len(ids))
+	_, readers := readBatch(readerContext(ctx, b.db.storage), b.db.size(), ids)
+	decodeParallel(len(ids), func(i int) {
+		r := &SafeReader{readers[i], ids[i]}
+		if errs[i] = b.db.seek(b.snap, r, ids[i]); errs[i] == nil {
+			errs[i] = items[i].Deserialize(r)
+		}
+	})
+	return errs
+}
+
 //Get the underlying DB
-func (b *brownBearGobReader) GetDB() *brownBearDB {
+func (b *brownBearSerializerReader) GetDB() *brownBearDB {
 	return b.db
 }
 
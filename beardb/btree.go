@@ -0,0 +1,414 @@
+package beardb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+//B+tree index
+/*=============================================================================
+A bTree keeps (key, id) pairs sorted in a BearStorage, so the ids of a range
+of keys are read in order. Keys are compared as bytes, and pairs with the same
+key by id, so a key can have many ids:
+
+BTree:
+-----------------------------------
+|magic|root int64|count int64|Node...
+-----------------------------------
+Node:
+-----------------------------------------------
+|leaf bool|count uint16|next int64|Entry...|
+-----------------------------------------------
+Entry:
+--------------------------------------------------
+|keylength uint16|key|id int64|child int64|
+--------------------------------------------------
+Child is only there in internal nodes, and leads to the pairs from the entry
+up to the next one. Next of an internal node leads to the pairs before its
+first entry, and next of a leaf is the leaf after it, or 0 for the last one.
+Nodes are split when they outgrow a page and never merged, so an iterator
+can go on from leaf to leaf while the tree changes.
+
+Like a hashIndex, changes are logged to a journal if one is given.
+=============================================================================*/
+const (
+	treeinfoLength    = 24
+	treenodeinfo      = 11
+	treePageLength    = 4096
+	treeMagic         = "BEARTREE"
+	maxTreeKeyLength  = 1024
+	treeEntryOverhead = 18 //Keylength, id and child
+)
+
+type treeEntry struct {
+	key   []byte
+	id    int64
+	child int64
+}
+
+//Order of a and b
+func compareEntry(a, b *treeEntry) int {
+	if c := bytes.Compare(a.key, b.key); c != 0 {
+		return c
+	}
+	switch {
+	case a.id < b.id:
+		return -1
+	case a.id > b.id:
+		return 1
+	}
+	return 0
+}
+
+type treeNode struct {
+	off     int64
+	leaf    bool
+	next    int64
+	entries []treeEntry
+}
+
+func (n *treeNode) length() int {
+	length := treenodeinfo
+	for _, e := range n.entries {
+		length += treeEntryOverhead + len(e.key)
+	}
+	return length
+}
+
+//Encode n into a page. N must fit in one.
+func (n *treeNode) encode() []byte {
+	buff := make([]byte, treePageLength)
+	if n.leaf {
+		buff[0] = 1
+	}
+	binary.LittleEndian.PutUint16(buff[1:], uint16(len(n.entries)))
+	binary.LittleEndian.PutUint64(buff[3:], uint64(n.next))
+	p := buff[treenodeinfo:]
+	for _, e := range n.entries {
+		binary.LittleEndian.PutUint16(p, uint16(len(e.key)))
+		copy(p[2:], e.key)
+		binary.LittleEndian.PutUint64(p[2+len(e.key):], uint64(e.id))
+		binary.LittleEndian.PutUint64(p[10+len(e.key):], uint64(e.child))
+		p = p[treeEntryOverhead+len(e.key):]
+	}
+	return buff
+}
+
+func readNode(r io.ReaderAt, off int64) (*treeNode, error) {
+	buff := make([]byte, treePageLength)
+	if _, err := r.ReadAt(buff, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	n := &treeNode{off: off, leaf: buff[0] == 1, next: int64(binary.LittleEndian.Uint64(buff[3:]))}
+	n.entries = make([]treeEntry, binary.LittleEndian.Uint16(buff[1:]))
+	p := buff[treenodeinfo:]
+	for i := range n.entries {
+		length := int(binary.LittleEndian.Uint16(p))
+		if len(p) < treeEntryOverhead+length {
+			return nil, errors.New("Tree node is corrupted")
+		}
+		n.entries[i] = treeEntry{append([]byte(nil), p[2:2+length]...),
+			int64(binary.LittleEndian.Uint64(p[2+length:])), int64(binary.LittleEndian.Uint64(p[10+length:]))}
+		p = p[treeEntryOverhead+length:]
+	}
+	return n, nil
+}
+
+//Index of the first entry of n not before e
+func (n *treeNode) search(e *treeEntry) int {
+	lo, hi := 0, len(n.entries)
+	for lo < hi {
+		m := (lo + hi) / 2
+		if compareEntry(&n.entries[m], e) < 0 {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo
+}
+
+//Child of internal node n leading to e
+func (n *treeNode) child(e *treeEntry) int64 {
+	i := n.search(e)
+	if i < len(n.entries) && compareEntry(&n.entries[i], e) == 0 {
+		return n.entries[i].child
+	}
+	if i == 0 {
+		return n.next
+	}
+	return n.entries[i-1].child
+}
+
+type bTree struct {
+	store *indexStorage
+	root  int64
+	count int64
+	lock  sync.RWMutex
+}
+
+//Open the B+tree in s, creating it if s is empty. Changes are logged to
+//journal first if it is not nil, and a change cut short by a crash is
+//completed here.
+func NewBTree(s BearStorage, journal BearStorage) (*bTree, error) {
+	store, err := openIndexStorage(s, journal, nil)
+	if err != nil {
+		return nil, err
+	}
+	t := &bTree{store: store}
+	if s.Size() == 0 {
+		sh := &shadow{base: s}
+		root := &treeNode{off: treeinfoLength, leaf: true}
+		if _, err := sh.WriteAt(root.encode(), root.off); err != nil {
+			return nil, err
+		}
+		if err := t.commit(sh, root.off, 0); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	buff := make([]byte, treeinfoLength)
+	if _, err := s.ReadAt(buff, 0); err != nil {
+		return nil, err
+	}
+	if string(buff[:8]) != treeMagic {
+		return nil, errors.New("Not a B+tree")
+	}
+	t.root = int64(binary.LittleEndian.Uint64(buff[8:]))
+	t.count = int64(binary.LittleEndian.Uint64(buff[16:]))
+	return t, nil
+}
+
+//Write the header to sh and make its writes. Must hold the write lock.
+func (t *bTree) commit(sh *shadow, root, count int64) error {
+	buff := make([]byte, treeinfoLength)
+	copy(buff, treeMagic)
+	binary.LittleEndian.PutUint64(buff[8:], uint64(root))
+	binary.LittleEndian.PutUint64(buff[16:], uint64(count))
+	if _, err := sh.WriteAt(buff, 0); err != nil {
+		return err
+	}
+	return t.store.change(sh.writes, func() { t.root, t.count = root, count })
+}
+
+//The nodes from the root down to the leaf where e belongs
+func (t *bTree) path(r io.ReaderAt, e *treeEntry) ([]*treeNode, error) {
+	var path []*treeNode
+	off := t.root
+	for {
+		n, err := readNode(r, off)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, n)
+		if n.leaf {
+			return path, nil
+		}
+		off = n.child(e)
+	}
+}
+
+//Add the pair (key, id). Adding a pair already there does nothing.
+func (t *bTree) Insert(key []byte, id int64) error {
+	if len(key) > maxTreeKeyLength {
+		return errors.New("Key is too long")
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sh := t.store.draft()
+	e := treeEntry{key: key, id: id}
+	path, err := t.path(sh, &e)
+	if err != nil {
+		return err
+	}
+	leaf := path[len(path)-1]
+	i := leaf.search(&e)
+	if i < len(leaf.entries) && compareEntry(&leaf.entries[i], &e) == 0 {
+		return nil
+	}
+	root := t.root
+	for level := len(path) - 1; ; level-- {
+		n := path[level]
+		i := n.search(&e)
+		n.entries = append(n.entries, treeEntry{})
+		copy(n.entries[i+1:], n.entries[i:])
+		n.entries[i] = e
+		if n.length() <= treePageLength {
+			_, err = sh.WriteAt(n.encode(), n.off)
+			break
+		}
+		var right *treeNode
+		if right, e, err = splitNode(sh, n); err != nil {
+			return err
+		}
+		if level == 0 { //Grow a new root
+			n := &treeNode{off: sh.Size(), next: n.off, entries: []treeEntry{e}}
+			n.entries[0].child = right.off
+			root = n.off
+			_, err = sh.WriteAt(n.encode(), n.off)
+			break
+		}
+		e.child = right.off
+	}
+	if err != nil {
+		return err
+	}
+	return t.commit(sh, root, t.count+1)
+}
+
+//Split n into itself and a new node after it, giving the new node and the
+//entry leading to it
+func splitNode(s BearStorage, n *treeNode) (*treeNode, treeEntry, error) {
+	half, m := n.length()/2, 0
+	for length := treenodeinfo; m < len(n.entries)-1 && length < half; m++ {
+		length += treeEntryOverhead + len(n.entries[m].key)
+	}
+	if m == 0 {
+		m = 1
+	}
+	right := &treeNode{off: s.Size(), leaf: n.leaf}
+	sep := n.entries[m]
+	if n.leaf {
+		right.entries = append([]treeEntry(nil), n.entries[m:]...)
+		right.next, n.next = n.next, right.off
+		sep.child = 0
+	} else { //The separator moves up
+		right.entries = append([]treeEntry(nil), n.entries[m+1:]...)
+		right.next = sep.child
+	}
+	n.entries = n.entries[:m]
+	if _, err := s.WriteAt(right.encode(), right.off); err != nil {
+		return nil, sep, err
+	}
+	_, err := s.WriteAt(n.encode(), n.off)
+	return right, sep, err
+}
+
+//Remove the pair (key, id), if it is there
+func (t *bTree) Remove(key []byte, id int64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sh := t.store.draft()
+	e := treeEntry{key: key, id: id}
+	path, err := t.path(sh, &e)
+	if err != nil {
+		return err
+	}
+	leaf := path[len(path)-1]
+	i := leaf.search(&e)
+	if i == len(leaf.entries) || compareEntry(&leaf.entries[i], &e) != 0 {
+		return nil
+	}
+	leaf.entries = append(leaf.entries[:i], leaf.entries[i+1:]...)
+	if _, err = sh.WriteAt(leaf.encode(), leaf.off); err != nil {
+		return err
+	}
+	return t.commit(sh, t.root, t.count-1)
+}
+
+//Number of pairs
+func (t *bTree) Len() int64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.count
+}
+
+//Sync the tree. The storages belong to the caller and stay open.
+func (t *bTree) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.store.close()
+}
+
+//Iterate over the pairs with keys in [lo, hi) in order. A nil lo or hi
+//leaves that end open.
+func (t *bTree) Range(lo, hi []byte) *treeIterator {
+	return &treeIterator{tree: t, lo: lo, hi: hi}
+}
+
+//Iterate over all pairs in order
+func (t *bTree) Scan() *treeIterator {
+	return t.Range(nil, nil)
+}
+
+//Key encoding v so that keys are in the order of the values
+func Int64Key(v int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(v)^1<<63)
+	return key
+}
+
+//Iterator
+//=============================================================================
+//An iterator reads a leaf at a time, so changes made to the tree while
+//iterating may or may not be seen.
+type treeIterator struct {
+	tree    *bTree
+	lo, hi  []byte
+	started bool
+	leaf    int64 //Next leaf to read, 0 if none
+	entries []treeEntry
+	last    treeEntry
+	after   bool //Last is a pair returned, so the next one is after it
+	err     error
+}
+
+//Move to the next pair, false if there is none or an error occurred
+func (it *treeIterator) Next() bool {
+	for len(it.entries) == 0 {
+		if it.err != nil || (it.started && it.leaf == 0) {
+			return false
+		}
+		if it.err = it.read(); it.err != nil {
+			return false
+		}
+	}
+	it.last, it.entries, it.after = it.entries[0], it.entries[1:], true
+	if it.hi != nil && bytes.Compare(it.last.key, it.hi) >= 0 {
+		it.leaf, it.entries = 0, nil
+		return false
+	}
+	return true
+}
+
+//Read the next leaf, keeping the entries after the last one
+func (it *treeIterator) read() error {
+	it.tree.lock.RLock()
+	defer it.tree.lock.RUnlock()
+	if !it.started { //Find the first leaf
+		it.last = treeEntry{key: it.lo, id: -1 << 63}
+		path, err := it.tree.path(it.tree.store.view(), &it.last)
+		if err != nil {
+			return err
+		}
+		it.leaf, it.started = path[len(path)-1].off, true
+	}
+	n, err := readNode(it.tree.store.view(), it.leaf)
+	if err != nil {
+		return err
+	}
+	i := n.search(&it.last)
+	if it.after && i < len(n.entries) && compareEntry(&n.entries[i], &it.last) == 0 {
+		i++
+	}
+	it.entries, it.leaf = n.entries[i:], n.next
+	return nil
+}
+
+//Key of the current pair
+func (it *treeIterator) Key() []byte {
+	return it.last.key
+}
+
+//Id of the current pair
+func (it *treeIterator) ID() int64 {
+	return it.last.id
+}
+
+//The error that stopped the iteration, if any
+func (it *treeIterator) Err() error {
+	return it.err
+}
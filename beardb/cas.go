@@ -0,0 +1,182 @@
+package beardb
+
+import (
+	"context"
+	"errors"
+)
+
+//Compare and swap
+/*=============================================================================
+Every entry of a versioned brownBearDB has a version, which is 1 when it is
+added and goes up by one with each Modify. It is kept in the entry, so it
+survives reopening the database. ModifyIf only modifies an entry still at the
+version the caller has read, so concurrent updates fail with ErrConflict
+instead of overwriting each other. Update reads, changes and writes back an
+entry, starting over on a conflict up to 16 times before giving up with
+ErrContended.
+
+Entries of a database that is not versioned have no version, and the
+operations here fail on it.
+=============================================================================*/
+const updateRetries = 16
+
+var (
+	ErrConflict  = errors.New("Item was modified concurrently")
+	ErrContended = errors.New("Item kept being modified concurrently")
+)
+
+//Version of the entry at id. Must hold the lock.
+func (db *brownBearDB) version(id int64) (uint32, error) {
+	if !db.versioned {
+		return 0, errors.New("Database is not versioned")
+	}
+	loc, err := latestVersion(db.storage, id)
+	if err != nil {
+		return 0, err
+	}
+	h, err := readVersionHeader(db.storage, loc)
+	if err != nil {
+		return 0, err
+	}
+	return h.version, nil
+}
+
+//Version of the entry at id
+func (db *brownBearDB) Version(id int64) (uint32, error) {
+	return db.VersionContext(context.Background(), id)
+}
+
+//Same as Version, giving up once ctx is done
+func (db *brownBearDB) VersionContext(ctx context.Context, id int64) (uint32, error) {
+	if err := db.rlock(ctx); err != nil {
+		return 0, err
+	}
+	defer db.rwlock.RUnlock()
+	return db.version(id)
+}
+
+//Put data into the entry at id if it is still at version expected
+func (db *brownBearDB) modifyIf(ctx context.Context, id int64, expected uint32, data []byte) error {
+	if err := db.lock(ctx); err != nil {
+		return err
+	}
+	defer db.rwlock.Unlock()
+	if err := db.checkVersion(id, expected); err != nil {
+		return err
+	}
+	return db.modify(id, data)
+}
+
+//Fail with ErrConflict unless the entry at id is at version expected. Must
+//hold the lock.
+func (db *brownBearDB) checkVersion(id int64, expected uint32) error {
+	v, err := db.version(id)
+	if err != nil {
+		return err
+	}
+	if v != expected {
+		return ErrConflict
+	}
+	return nil
+}
+
+//Gob
+//=============================================================================
+
+//Modify items at id if it is still at version expected, or fail with
+//ErrConflict
+func (b *brownBearGobWriter) ModifyIf(id int64, expected uint32, items ...interface{}) error {
+	return b.ModifyIfContext(context.Background(), id, expected, items...)
+}
+
+//Same as ModifyIf, giving up once ctx is done
+func (b *brownBearGobWriter) ModifyIfContext(ctx context.Context, id int64, expected uint32, items ...interface{}) error {
+	if err := b.db.lock(ctx); err != nil {
+		return err
+	}
+	defer b.db.rwlock.Unlock()
+	if err := b.db.checkVersion(id, expected); err != nil {
+		return err
+	}
+	data, err := b.encode(b.db.indexed(), items...)
+	if err != nil {
+		return err
+	}
+	return b.db.modify(id, data)
+}
+
+//Read the item at id into item with r, and replace it with what update
+//returns, starting over if it was modified in between. Gives up with
+//ErrContended after 16 tries. As gob only sends type information
+//with the first item, r must be a reader able to decode the item.
+func (b *brownBearGobWriter) Update(r *brownBearGobReader, id int64, item interface{}, update func(old interface{}) (interface{}, error)) error {
+	return b.UpdateContext(context.Background(), r, id, item, update)
+}
+
+//Same as Update, giving up once ctx is done
+func (b *brownBearGobWriter) UpdateContext(ctx context.Context, r *brownBearGobReader, id int64, item interface{}, update func(old interface{}) (interface{}, error)) error {
+	for i := 0; i < updateRetries; i++ {
+		v, err := b.db.VersionContext(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err = r.GetItemContext(ctx, id, item); err != nil {
+			return err
+		}
+		n, err := update(item)
+		if err != nil {
+			return err
+		}
+		if err = b.ModifyIfContext(ctx, id, v, n); err != ErrConflict {
+			return err
+		}
+	}
+	return ErrContended
+}
+
+//Serializer
+//=============================================================================
+
+//Modify items at id if it is still at version expected, or fail with
+//ErrConflict
+func (b *brownBearSerializerWriter) ModifyIf(id int64, expected uint32, items ...Serializer) error {
+	return b.ModifyIfContext(context.Background(), id, expected, items...)
+}
+
+//Same as ModifyIf, giving up once ctx is done
+func (b *brownBearSerializerWriter) ModifyIfContext(ctx context.Context, id int64, expected uint32, items ...Serializer) error {
+	data, err := b.encode(items...)
+	if err != nil {
+		return err
+	}
+	return b.db.modifyIf(ctx, id, expected, data)
+}
+
+//Read the item at id into item, and replace it with what update returns,
+//starting over if it was modified in between. Gives up with ErrContended
+//after 16 tries.
+func (b *brownBearSerializerWriter) Update(id int64, item Serializer, update func(old Serializer) (Serializer, error)) error {
+	return b.UpdateContext(context.Background(), id, item, update)
+}
+
+//Same as Update, giving up once ctx is done
+func (b *brownBearSerializerWriter) UpdateContext(ctx context.Context, id int64, item Serializer, update func(old Serializer) (Serializer, error)) error {
+	r := b.db.NewSerializerReader()
+	for i := 0; i < updateRetries; i++ {
+		v, err := b.db.VersionContext(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err = r.GetItemContext(ctx, id, item); err != nil {
+			return err
+		}
+		n, err := update(item)
+		if err != nil {
+			return err
+		}
+		if err = b.ModifyIfContext(ctx, id, v, n); err != ErrConflict {
+			return err
+		}
+	}
+	return ErrContended
+}
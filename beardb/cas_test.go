@@ -0,0 +1,101 @@
+package beardb
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestModifyIf(t *testing.T) {
+	db := NewVersionedBrownBearDB(NewKoala(0), 0)
+	w := db.NewSerializerWriter()
+	id, err := w.AddItem(NewInt64(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.ModifyIf(id, 1, NewInt64(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.ModifyIf(id, 1, NewInt64(3)); err != ErrConflict {
+		t.Fatalf("ModifyIf at an old version gave %v, want ErrConflict", err)
+	}
+	if v, err := db.Version(id); err != nil || v != 2 {
+		t.Fatalf("version is %d, %v after a conflict, want 2", v, err)
+	}
+	if err = NewBrownBearDB(NewKoala(0)).NewSerializerWriter().ModifyIf(0, 1, NewInt64(1)); err == nil {
+		t.Fatal("ModifyIf on a database that is not versioned succeeded")
+	}
+}
+
+//Concurrent Updates lose no increment, and only give up with ErrContended
+func TestUpdateContention(t *testing.T) {
+	db := NewVersionedBrownBearDB(NewKoala(0), 4)
+	id, err := db.NewSerializerWriter().AddItem(NewInt64(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	done := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := db.NewSerializerWriter()
+			for j := 0; j < rounds; j++ {
+				err := w.Update(id, new(Int64), func(old Serializer) (Serializer, error) {
+					return NewInt64(old.(*Int64).Get() + 1), nil
+				})
+				if err != nil && err != ErrContended {
+					t.Error(err)
+					return
+				}
+				if err == nil {
+					lock.Lock()
+					done++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	got := new(Int64)
+	if err = db.NewSerializerReader().GetItem(id, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get() != int64(done) {
+		t.Fatalf("counter is %d after %d updates", got.Get(), done)
+	}
+	if done == 0 {
+		t.Fatal("every update gave up")
+	}
+}
+
+//An item modified behind every try makes Update give up after 16 of them
+func TestUpdateContended(t *testing.T) {
+	db := NewVersionedBrownBearDB(NewKoala(0), 0)
+	w := db.NewSerializerWriter()
+	id, err := w.AddItem(NewInt64(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := db.NewSerializerWriter()
+	tries := 0
+	err = w.Update(id, new(Int64), func(old Serializer) (Serializer, error) {
+		tries++
+		if err := other.Modify(id, NewInt64(-1)); err != nil {
+			return nil, err
+		}
+		return NewInt64(old.(*Int64).Get() + 1), nil
+	})
+	if err != ErrContended {
+		t.Fatalf("Update gave %v, want ErrContended", err)
+	}
+	if tries != updateRetries {
+		t.Fatalf("Update tried %d times, want %d", tries, updateRetries)
+	}
+	got := new(Int64)
+	if err = db.NewSerializerReader().GetItem(id, got); err != nil || got.Get() != -1 {
+		t.Fatalf("item is %d, %v, want what the other writer wrote", got.Get(), err)
+	}
+}
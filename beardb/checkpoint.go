@@ -0,0 +1,132 @@
+package beardb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//Checkpoint files
+/*=============================================================================
+A checkpoint is a point-in-time image of an in-memory storage:
+---------------------------------------------------------
+|magic|version|crc uint32|size int64|seq int64|  image  |
+---------------------------------------------------------
+Crc is the checksum of the image and size its length. Seq is free for the
+writer to record where the image stands, e.g. in a log.
+Checkpoints are written to a temporary file which is renamed over the old
+one, so a crash never leaves a half-written checkpoint behind.
+=============================================================================*/
+const (
+	checkpointinfoLength = 32
+	checkpointVersion    = 1
+	checkpointMagic      = "BEARCKPT"
+)
+
+//Storages able to hand out a stable image of their content without copying
+type freezer interface {
+	//The returned slice is never changed by later writes
+	freeze() []byte
+}
+
+//Atomically write image to path as a checkpoint
+func writeCheckpoint(path string, image []byte, seq int64) error {
+	header := make([]byte, checkpointinfoLength)
+	copy(header, checkpointMagic)
+	binary.LittleEndian.PutUint32(header[8:], checkpointVersion)
+	binary.LittleEndian.PutUint32(header[12:], crc32.ChecksumIEEE(image))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(image)))
+	binary.LittleEndian.PutUint64(header[24:], uint64(seq))
+
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) //No-op once renamed
+	if _, err = file.Write(header); err == nil {
+		if _, err = file.Write(image); err == nil {
+			err = file.Sync()
+		}
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil { //Make the rename durable
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+//Read and validate the checkpoint at path
+func readCheckpoint(path string) (image []byte, seq int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, checkpointinfoLength)
+	if _, err = io.ReadFull(file, header); err != nil {
+		return nil, 0, errors.New("Checkpoint header is truncated")
+	}
+	if string(header[:8]) != checkpointMagic {
+		return nil, 0, errors.New("Not a checkpoint")
+	}
+	if binary.LittleEndian.Uint32(header[8:]) != checkpointVersion {
+		return nil, 0, errors.New("Unknown checkpoint version")
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(binary.LittleEndian.Uint64(header[16:]))
+	if size != fi.Size()-checkpointinfoLength {
+		return nil, 0, errors.New("Checkpoint size mismatch")
+	}
+	image = make([]byte, size)
+	if _, err = io.ReadFull(file, image); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(image) != binary.LittleEndian.Uint32(header[12:]) {
+		return nil, 0, errors.New("Checkpoint checksum mismatch")
+	}
+	return image, int64(binary.LittleEndian.Uint64(header[24:])), nil
+}
+
+//Take an image of the storage of t while holding lock, then write it out in
+//the background
+func checkpoint(lock sync.Locker, t *tracker, path string) <-chan error {
+	done := make(chan error, 1)
+	f, ok := t.BearStorage.(freezer)
+	if !ok {
+		done <- errors.New("Storage cannot be checkpointed")
+		return done
+	}
+	lock.Lock()
+	if t.closed {
+		lock.Unlock()
+		done <- ErrClosed
+		return done
+	}
+	image := f.freeze()
+	lock.Unlock()
+	go func() {
+		done <- writeCheckpoint(path, image, 0)
+	}()
+	return done
+}
@@ -0,0 +1,187 @@
+package beardb
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+//Context support
+/*=============================================================================
+The Context variants of the methods give up while waiting for the lock of the
+bear once ctx is done, and readers check ctx before every read from the
+storage. Once a writer has started writing it finishes, so an entry is never
+left half-written because of ctx.
+=============================================================================*/
+
+//A readers-writer lock whose waiters can give up
+//=============================================================================
+//Waiters queue in order, and a reader waits behind a waiting writer as with
+//sync.RWMutex. Each waiter is handed the lock by closing its channel, so
+//giving up needs no goroutine.
+type rwMutex struct {
+	held    int //Readers holding the lock, or -1 for a writer
+	waiters []*lockWaiter
+	lock    sync.Mutex
+}
+
+type lockWaiter struct {
+	write bool
+	ready chan struct{}
+}
+
+func (m *rwMutex) free(write bool) bool {
+	if write {
+		return m.held == 0
+	}
+	return m.held >= 0
+}
+
+func (m *rwMutex) take(write bool) {
+	if write {
+		m.held = -1
+	} else {
+		m.held++
+	}
+}
+
+//Hand the lock to the waiters at the front it is free for. Must hold m.lock.
+func (m *rwMutex) wake() {
+	for len(m.waiters) > 0 && m.free(m.waiters[0].write) {
+		w := m.waiters[0]
+		m.waiters = m.waiters[1:]
+		m.take(w.write)
+		close(w.ready)
+	}
+}
+
+//Acquire the lock, giving up once ctx is done. Nil is returned only if the
+//lock is held.
+func (m *rwMutex) acquire(ctx context.Context, write bool) error {
+	m.lock.Lock()
+	if len(m.waiters) == 0 && m.free(write) {
+		m.take(write)
+		m.lock.Unlock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		m.lock.Unlock()
+		return err
+	}
+	w := &lockWaiter{write, make(chan struct{})}
+	m.waiters = append(m.waiters, w)
+	m.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	select {
+	case <-w.ready: //Handed the lock meanwhile
+		return nil
+	default:
+	}
+	for i, o := range m.waiters {
+		if o == w {
+			m.waiters = append(m.waiters[:i], m.waiters[i+1:]...)
+			break
+		}
+	}
+	m.wake() //A writer giving up may let readers behind it in
+	return ctx.Err()
+}
+
+func (m *rwMutex) release(write bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if write {
+		m.held = 0
+	} else {
+		m.held--
+	}
+	m.wake()
+}
+
+func (m *rwMutex) Lock() {
+	m.acquire(context.Background(), true)
+}
+
+func (m *rwMutex) Unlock() {
+	m.release(true)
+}
+
+func (m *rwMutex) RLock() {
+	m.acquire(context.Background(), false)
+}
+
+func (m *rwMutex) RUnlock() {
+	m.release(false)
+}
+
+func (m *rwMutex) lockContext(ctx context.Context) error {
+	return m.acquire(ctx, true)
+}
+
+//The read side of m as a contextLocker
+func (m *rwMutex) RLocker() contextLocker {
+	return rlocker{m}
+}
+
+type rlocker struct {
+	m *rwMutex
+}
+
+func (r rlocker) Lock()   { r.m.RLock() }
+func (r rlocker) Unlock() { r.m.RUnlock() }
+
+func (r rlocker) lockContext(ctx context.Context) error {
+	return r.m.acquire(ctx, false)
+}
+
+//A lock that can be given up on
+type contextLocker interface {
+	sync.Locker
+	lockContext(ctx context.Context) error
+}
+
+//Acquire l, giving up once ctx is done. Nil is returned only if l is held.
+func lockContext(ctx context.Context, l contextLocker) error {
+	return l.lockContext(ctx)
+}
+
+//Acquire l like lockContext, failing with ErrClosed once the bear of t is
+//closed
+func lockOpen(ctx context.Context, l contextLocker, t *tracker) error {
+	if err := lockContext(ctx, l); err != nil {
+		return err
+	}
+	if t.closed {
+		l.Unlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+//Fails reads once ctx is done
+type contextReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+}
+
+func (c contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.ReadAt(p, off)
+}
+
+//Read from r under ctx
+func readerContext(ctx context.Context, r io.ReaderAt) io.ReaderAt {
+	if ctx.Done() == nil {
+		return r
+	}
+	return contextReaderAt{ctx, r}
+}
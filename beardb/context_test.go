@@ -0,0 +1,105 @@
+package beardb
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Long enough for a waiter to have got the lock if it could
+const lockWait = 20 * time.Millisecond
+
+//A writer cancelled while queued lets in the readers queued behind it
+func TestRWMutexCancelQueued(t *testing.T) {
+	var m rwMutex
+	m.RLock()
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := make(chan error)
+	go func() { writer <- m.lockContext(ctx) }()
+	time.Sleep(lockWait)
+
+	const readers = 3
+	in := make(chan struct{}, readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			m.RLock()
+			in <- struct{}{}
+		}()
+	}
+	time.Sleep(lockWait)
+	select {
+	case <-in:
+		t.Fatal("a reader went past the queued writer")
+	default:
+	}
+
+	cancel()
+	if err := <-writer; err != context.Canceled {
+		t.Fatalf("cancelled writer gave %v", err)
+	}
+	for i := 0; i < readers; i++ {
+		select {
+		case <-in:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the readers behind a cancelled writer never got in")
+		}
+	}
+	for i := 0; i <= readers; i++ {
+		m.RUnlock()
+	}
+	if m.held != 0 || len(m.waiters) != 0 {
+		t.Fatalf("%d holders and %d waiters left", m.held, len(m.waiters))
+	}
+}
+
+//Waits given up leave no goroutine behind
+func TestRWMutexNoHelpers(t *testing.T) {
+	var m rwMutex
+	m.Lock()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 1000; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Microsecond)
+		if err := m.RLocker().lockContext(ctx); err == nil {
+			t.Fatal("got the read lock under a writer")
+		}
+		cancel()
+	}
+	if after := runtime.NumGoroutine(); after > before+2 {
+		t.Fatalf("%d goroutines after giving up waits, %d before", after, before)
+	}
+	m.Unlock()
+}
+
+//Writers exclude everyone while waits are given up all around
+func TestRWMutexStress(t *testing.T) {
+	var m rwMutex
+	var wg sync.WaitGroup
+	count := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(j%3)*time.Microsecond)
+				if i%2 == 0 {
+					if m.lockContext(ctx) == nil {
+						count++
+						m.Unlock()
+					}
+				} else if m.RLocker().lockContext(ctx) == nil {
+					_ = count
+					m.RUnlock()
+				}
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	m.Lock()
+	m.Unlock()
+	if m.held != 0 || len(m.waiters) != 0 {
+		t.Fatalf("%d holders and %d waiters left", m.held, len(m.waiters))
+	}
+}
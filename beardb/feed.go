@@ -0,0 +1,256 @@
+package beardb
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+//Change feed
+/*=============================================================================
+With a feed enabled, every append, modify and delete done by the writers of a
+bear is also recorded in a storage of its own, in the order they happened:
+
+FeedRecord:
+---------------------------
+|id int64|tail int64|kind|
+---------------------------
+Tail is the size of the bear just before the change, so it never goes down,
+and for an append it is the id itself. The top bit of kind marks the change
+as made. A subscriber reads the feed at its own pace and never holds up
+writers.
+
+The records of a write are written and synced before its changes are made,
+and marked and delivered once they are done, so a change that made it to the
+storage is always in the feed after a crash. The marks are synced along with
+the records of the next write, or on Close. A crash in between can leave
+records of changes that never happened: they are delivered as Unconfirmed,
+and it is up to the subscriber to look at the bear. This costs a sync of the
+feed for every write, however many items it changes.
+
+Subscribing from an id delivers every change made after the append of that
+id, so a consumer resumes by passing the id of the last append it handled.
+Changes after that append which it has already handled are delivered again.
+Pass -1 to start from the very beginning.
+=============================================================================*/
+const (
+	feedRecordLength = 17
+	feedBatch        = 256
+	feedDone         = 0x80 //Bit of kind marking the change as made
+)
+
+type EventKind byte
+
+const (
+	EventAppend EventKind = iota
+	EventModify
+	EventDelete
+)
+
+//A change to the entry at ID
+type Event struct {
+	ID          int64
+	Kind        EventKind
+	Unconfirmed bool //Logged before a crash, but maybe never made
+}
+
+type feedRecord struct {
+	id   int64
+	tail int64
+	kind EventKind
+}
+
+type feed struct {
+	storage BearStorage
+	count   int64  //Whole records published
+	logged  int64  //Records logged after them, not yet published
+	pending []byte //Records logged, to be marked once published
+	closed  bool   //Set once the bear is closed
+	signal  broadcast
+	lock    sync.Mutex
+}
+
+//Open the feed in s, dropping a torn record at the end
+func newFeed(s BearStorage) (*feed, error) {
+	count := s.Size() / feedRecordLength
+	if count*feedRecordLength != s.Size() {
+		if err := s.Truncate(count * feedRecordLength); err != nil {
+			return nil, err
+		}
+	}
+	return &feed{storage: s, count: count}, nil
+}
+
+//Durably write records after the last one, before the changes they record
+//are made. They are delivered once published. Must hold the write lock of
+//the bear, so records are in the order of the changes.
+func (f *feed) log(records ...feedRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	buff := make([]byte, len(records)*feedRecordLength)
+	for i, r := range records {
+		p := buff[i*feedRecordLength:]
+		binary.LittleEndian.PutUint64(p, uint64(r.id))
+		binary.LittleEndian.PutUint64(p[8:], uint64(r.tail))
+		p[16] = byte(r.kind)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, err := f.storage.WriteAt(buff, (f.count+f.logged)*feedRecordLength); err != nil {
+		return err
+	}
+	f.logged += int64(len(records))
+	f.pending = append(f.pending, buff...)
+	return syncStorage(f.storage)
+}
+
+//Mark the first n records logged as made and deliver them, and drop the
+//rest, whose changes were not made. Must hold the write lock of the bear.
+func (f *feed) publish(n int) error {
+	var err error
+	f.lock.Lock()
+	if n > 0 {
+		done := f.pending[:n*feedRecordLength]
+		for i := 0; i < n; i++ {
+			done[i*feedRecordLength+16] |= feedDone
+		}
+		_, err = f.storage.WriteAt(done, f.count*feedRecordLength)
+	}
+	f.count += int64(n)
+	f.logged = 0
+	f.pending = f.pending[:0]
+	end := f.count * feedRecordLength
+	f.lock.Unlock()
+	if n > 0 {
+		f.signal.notify()
+	}
+	if f.storage.Size() > end {
+		if terr := f.storage.Truncate(end); err == nil {
+			err = terr
+		}
+	}
+	return err
+}
+
+func (f *feed) records() (count int64, closed bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.count, f.closed
+}
+
+//Sync the feed and end every subscription once it has caught up. The
+//storage belongs to the caller and stays open.
+func (f *feed) close() error {
+	f.lock.Lock()
+	f.closed = true
+	f.lock.Unlock()
+	f.signal.notify()
+	return syncStorage(f.storage)
+}
+
+//Read the events recorded in [from, to)
+func (f *feed) read(from, to int64) ([]Event, error) {
+	buff := make([]byte, (to-from)*feedRecordLength)
+	if _, err := f.storage.ReadAt(buff, from*feedRecordLength); err != nil && err != io.EOF {
+		return nil, err
+	}
+	events := make([]Event, to-from)
+	for i := range events {
+		p := buff[i*feedRecordLength:]
+		events[i] = Event{ID: int64(binary.LittleEndian.Uint64(p)),
+			Kind: EventKind(p[16] &^ feedDone), Unconfirmed: p[16]&feedDone == 0}
+	}
+	return events, nil
+}
+
+//Index of the first record made after the append of id
+func (f *feed) search(id int64) (int64, error) {
+	var err error
+	tail := make([]byte, 8)
+	count, _ := f.records()
+	i := sort.Search(int(count), func(i int) bool {
+		if _, rerr := f.storage.ReadAt(tail, int64(i)*feedRecordLength+8); rerr != nil && err == nil {
+			err = rerr
+		}
+		return int64(binary.LittleEndian.Uint64(tail)) > id
+	})
+	return int64(i), err
+}
+
+//Subscription
+//=============================================================================
+type subscription struct {
+	C    <-chan Event //Closed when the subscription ends
+	c    chan Event
+	feed *feed
+	err  error
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func subscribe(f *feed, fromID int64, buffer int) (*subscription, error) {
+	if f == nil {
+		return nil, errors.New("Feed is not enabled")
+	}
+	pos, err := f.search(fromID)
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan Event, buffer)
+	s := &subscription{C: c, c: c, feed: f, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.run(pos)
+	return s, nil
+}
+
+func (s *subscription) run(pos int64) {
+	defer close(s.done)
+	defer close(s.c)
+	for {
+		more := s.feed.signal.wait() //Before looking, so no record is missed
+		count, closed := s.feed.records()
+		for pos < count {
+			to := pos + feedBatch
+			if to > count {
+				to = count
+			}
+			events, err := s.feed.read(pos, to)
+			if err != nil {
+				s.err = err
+				return
+			}
+			for _, e := range events {
+				select { //Blocks while the consumer is behind
+				case s.c <- e:
+				case <-s.stop:
+					return
+				}
+			}
+			pos = to
+		}
+		if closed {
+			s.err = ErrClosed
+			return
+		}
+		select {
+		case <-more:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+//End the subscription. C is closed once it has stopped.
+func (s *subscription) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+//The error that ended the subscription, if any. Valid once C is closed.
+func (s *subscription) Err() error {
+	return s.err
+}
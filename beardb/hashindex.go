@@ -0,0 +1,641 @@
+package beardb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+//Hash index
+/*=============================================================================
+A hashIndex maps byte-string keys to int64 ids in a BearStorage with linear
+hashing. Buckets are split one at a time as the index grows, so growing never
+holds up readers for longer than a single put:
+
+HashIndex:
+-------------------------------------------------------------------------------
+|magic|level uint32|next uint32|count int64|used int64|rate float64|Segment x 32|
+|Filter x 32|...
+-------------------------------------------------------------------------------
+There are initial<<level+next buckets, and next is the bucket to split next.
+Count is the number of keys and used the bytes of their records. Segment j is
+where the pages of buckets [initial<<(j-1), initial<<j) are, or those of the
+first initial buckets for j=0, so a bucket is found without a directory. 0 is
+a segment not allocated yet.
+
+Filter:
+----------------------------------------
+|off int64|length uint32|hashes uint32|
+----------------------------------------
+With a false positive rate other than 0, every bucket has a Bloom filter of
+the keys put in it. Those of a segment are at off, length bytes each, sized
+for a full page of records as long as those put before the segment was
+allocated. The filters are kept in memory, and a key the filter of its bucket
+has never seen is not looked for in the pages. A split builds the filters of
+both buckets again, and until then deleted keys stay in a filter, which only
+makes it less sharp.
+
+Page:
+-------------------------------------------
+|next int64|used uint16|Record...|unused|
+-------------------------------------------
+Record:
+-------------------------------------
+|keylength uint16|key|id int64|
+-------------------------------------
+A bucket is a page in its segment and the overflow pages chained from it.
+
+Every change, a split included, is made against a shadow of the storage
+first, while readers go on. With a journal its writes are logged there before
+being made, and made again on the next open if a crash cuts them short, so
+the index is never left half changed. Readers are only held off while the
+index switches to the change, and read its writes through until they are
+made.
+=============================================================================*/
+const (
+	hashinfoLength   = 808
+	hashfilterinfo   = 16
+	hashSegments     = 32
+	hashPageLength   = 4096
+	hashpageinfo     = 10
+	hashrecordinfo   = 10
+	hashInitial      = 4
+	hashMagic        = "BEARHASH"
+	maxHashKeyLength = hashPageLength - hashpageinfo - hashrecordinfo
+	hashAverageKeys  = 128 //Keys per bucket assumed before there are any
+)
+
+type hashState struct {
+	level    uint32
+	next     uint32
+	count    int64
+	used     int64
+	rate     float64
+	segments [hashSegments]int64
+	filters  [hashSegments]bloomFilter //Of the buckets of each segment
+	rebuilt  []bloomFilter             //Copied into filters on commit
+}
+
+type hashIndex struct {
+	store *indexStorage
+	state hashState
+	lock  sync.RWMutex //Taken by readers, and by the writer to switch
+	write sync.Mutex   //Held by the writer
+}
+
+//Open the hash index in s, creating it if s is empty. Changes are logged to
+//journal first if it is not nil, and a change cut short by a crash is
+//completed here. A new index has Bloom filters with a false positive rate
+//of 1%.
+func NewHashIndex(s BearStorage, journal BearStorage) (*hashIndex, error) {
+	return NewFilteredHashIndex(s, journal, defaultFalsePositiveRate)
+}
+
+//Same as NewHashIndex, with Bloom filters of false positive rate rate for a
+//new index, or none if it is 0. An index keeps the rate it was created with.
+func NewFilteredHashIndex(s BearStorage, journal BearStorage, rate float64) (*hashIndex, error) {
+	if rate < 0 || rate >= 1 {
+		return nil, errors.New("False positive rate must be in [0, 1)")
+	}
+	h := &hashIndex{}
+	store, err := openIndexStorage(s, journal, &h.lock)
+	if err != nil {
+		return nil, err
+	}
+	h.store = store
+	if s.Size() == 0 {
+		sh := &shadow{base: s, size: hashinfoLength}
+		state := hashState{rate: rate}
+		if err := state.allocate(sh, 0); err != nil {
+			return nil, err
+		}
+		if err := h.commit(sh, state); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	buff := make([]byte, hashinfoLength)
+	if _, err := s.ReadAt(buff, 0); err != nil {
+		return nil, err
+	}
+	if string(buff[:8]) != hashMagic {
+		return nil, errors.New("Not a hash index")
+	}
+	h.state.level = binary.LittleEndian.Uint32(buff[8:])
+	h.state.next = binary.LittleEndian.Uint32(buff[12:])
+	h.state.count = int64(binary.LittleEndian.Uint64(buff[16:]))
+	h.state.used = int64(binary.LittleEndian.Uint64(buff[24:]))
+	h.state.rate = math.Float64frombits(binary.LittleEndian.Uint64(buff[32:]))
+	for j := range h.state.segments {
+		h.state.segments[j] = int64(binary.LittleEndian.Uint64(buff[40+8*j:]))
+		p := buff[40+8*hashSegments+hashfilterinfo*j:]
+		f := &h.state.filters[j]
+		if f.off = int64(binary.LittleEndian.Uint64(p)); f.off == 0 {
+			continue
+		}
+		f.bits = make([]byte, int64(binary.LittleEndian.Uint32(p[8:]))*segmentBuckets(j))
+		f.hashes = binary.LittleEndian.Uint32(p[12:])
+		if _, err := s.ReadAt(f.bits, f.off); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+//Allocate the pages of segment j at the end of s, and its filter if any
+func (state *hashState) allocate(s BearStorage, j int) error {
+	buckets := segmentBuckets(j)
+	state.segments[j] = s.Size()
+	if _, err := s.WriteAt(make([]byte, buckets*hashPageLength), state.segments[j]); err != nil {
+		return err
+	}
+	if state.rate == 0 {
+		return nil
+	}
+	perBucket := int64(hashAverageKeys)
+	if state.count > 0 {
+		perBucket = hashPageLength * state.count / state.used
+	}
+	length, hashes := bloomSize(perBucket, state.rate)
+	state.filters[j] = bloomFilter{off: s.Size(), hashes: hashes, bits: make([]byte, buckets*length)}
+	_, err := s.WriteAt(state.filters[j].bits, state.filters[j].off)
+	return err
+}
+
+//Storage of an index
+//=============================================================================
+//A change is logged to the journal if any, switched to at once under the
+//lock readers take, then made. Until it is made, synced and cleared from the
+//journal, readers read it through, so the lock is only held for the switch.
+//A change left pending by a failure is made before the next is logged, so
+//it is never dropped from the journal.
+type indexStorage struct {
+	storage BearStorage
+	journal *wal          //Nil if not crash-safe
+	pending []shadowWrite //Switched to and not made yet, nil if none
+	lock    sync.Locker   //Taken for a switch, nil if writers hold it anyway
+}
+
+//Open the storage of an index in s, completing the change logged to journal
+//that a crash cut short, if any
+func openIndexStorage(s, journal BearStorage, lock sync.Locker) (*indexStorage, error) {
+	is := &indexStorage{storage: s, lock: lock}
+	if journal == nil {
+		return is, nil
+	}
+	is.journal = &wal{storage: journal}
+	writes, err := is.journal.pending()
+	if err != nil {
+		return nil, err
+	}
+	is.pending = writes
+	if err = is.settle(); err != nil {
+		return nil, err
+	}
+	return is, nil
+}
+
+//The storage with the change switched to. Must hold the read lock, or be
+//the writer.
+func (is *indexStorage) view() BearStorage {
+	if is.pending == nil {
+		return is.storage
+	}
+	sh := &shadow{base: is.storage, size: is.storage.Size(), writes: is.pending}
+	for _, w := range is.pending {
+		if end := w.off + int64(len(w.data)); end > sh.size {
+			sh.size = end
+		}
+	}
+	return sh
+}
+
+//A shadow to work out a change on. Must be the writer.
+func (is *indexStorage) draft() *shadow {
+	v := is.view()
+	return &shadow{base: v, size: v.Size()}
+}
+
+func (is *indexStorage) switchTo(writes []shadowWrite, swap func()) {
+	if is.lock != nil {
+		is.lock.Lock()
+		defer is.lock.Unlock()
+	}
+	is.pending = writes
+	swap()
+}
+
+//Log writes, switch to them calling swap, then make them. Once switched to
+//they stay, and if making them fails they are made before the next change.
+//Must be the writer.
+func (is *indexStorage) change(writes []shadowWrite, swap func()) error {
+	if err := is.settle(); err != nil {
+		return err
+	}
+	if len(writes) == 0 {
+		is.switchTo(nil, swap)
+		return nil
+	}
+	if is.journal != nil {
+		if err := is.journal.log(writes); err != nil {
+			return err
+		}
+	}
+	is.switchTo(writes, swap)
+	return is.settle()
+}
+
+//Make the change switched to, if any. Must be the writer.
+func (is *indexStorage) settle() error {
+	if is.pending == nil {
+		return nil
+	}
+	for _, w := range is.pending {
+		if _, err := is.storage.WriteAt(w.data, w.off); err != nil {
+			return err
+		}
+	}
+	if is.journal != nil {
+		if err := syncStorage(is.storage); err != nil {
+			return err
+		}
+		if err := is.journal.clear(); err != nil {
+			return err
+		}
+	}
+	is.switchTo(nil, func() {})
+	return nil
+}
+
+//Settle and sync the storage. Must be the writer.
+func (is *indexStorage) close() error {
+	if err := is.settle(); err != nil {
+		return err
+	}
+	return syncStorage(is.storage)
+}
+
+//Write state to sh and make its writes, switching to state. Must be the
+//writer.
+func (h *hashIndex) commit(sh *shadow, state hashState) error {
+	buff := make([]byte, hashinfoLength)
+	copy(buff, hashMagic)
+	binary.LittleEndian.PutUint32(buff[8:], state.level)
+	binary.LittleEndian.PutUint32(buff[12:], state.next)
+	binary.LittleEndian.PutUint64(buff[16:], uint64(state.count))
+	binary.LittleEndian.PutUint64(buff[24:], uint64(state.used))
+	binary.LittleEndian.PutUint64(buff[32:], math.Float64bits(state.rate))
+	for j, seg := range state.segments {
+		binary.LittleEndian.PutUint64(buff[40+8*j:], uint64(seg))
+		p := buff[40+8*hashSegments+hashfilterinfo*j:]
+		f := &state.filters[j]
+		binary.LittleEndian.PutUint64(p, uint64(f.off))
+		binary.LittleEndian.PutUint32(p[8:], uint32(int64(len(f.bits))/segmentBuckets(j)))
+		binary.LittleEndian.PutUint32(p[12:], f.hashes)
+	}
+	if _, err := sh.WriteAt(buff, 0); err != nil {
+		return err
+	}
+	return h.store.change(sh.writes, func() {
+		for _, f := range state.rebuilt {
+			for j := range state.filters {
+				if g := &state.filters[j]; g.off != 0 && f.off >= g.off && f.off < g.off+int64(len(g.bits)) {
+					copy(g.bits[f.off-g.off:], f.bits)
+				}
+			}
+		}
+		state.rebuilt = nil
+		h.state = state
+	})
+}
+
+func hashKey(key []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(key)
+	return f.Sum64()
+}
+
+//Bucket of a key hashing to k
+func (state *hashState) bucket(k uint64) uint64 {
+	b := k % (hashInitial << state.level)
+	if b < uint64(state.next) {
+		b = k % (hashInitial << (state.level + 1))
+	}
+	return b
+}
+
+//Segment of bucket b, and its place in it
+func segment(b uint64) (int, int64) {
+	j := bits.Len64(b / hashInitial)
+	if j == 0 {
+		return 0, int64(b)
+	}
+	return j, int64(b - hashInitial<<(j-1))
+}
+
+//Number of buckets in segment j
+func segmentBuckets(j int) int64 {
+	if j == 0 {
+		return hashInitial
+	}
+	return hashInitial << (j - 1)
+}
+
+//Offset of the first page of bucket b
+func (state *hashState) page(b uint64) int64 {
+	j, i := segment(b)
+	return state.segments[j] + i*hashPageLength
+}
+
+//Filter of bucket b, nil if there is none
+func (state *hashState) filter(b uint64) *bloomFilter {
+	j, i := segment(b)
+	f := &state.filters[j]
+	if f.off == 0 {
+		return nil
+	}
+	length := int64(len(f.bits)) / segmentBuckets(j)
+	return &bloomFilter{f.off + i*length, f.hashes, f.bits[i*length : (i+1)*length]}
+}
+
+//Whether a key hashing to k may be in the index
+func (state *hashState) mayContain(k uint64) bool {
+	f := state.filter(state.bucket(k))
+	return f == nil || f.mayContain(k)
+}
+
+func readPage(r io.ReaderAt, off int64) ([]byte, error) {
+	page := make([]byte, hashPageLength)
+	if _, err := r.ReadAt(page, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return page, nil
+}
+
+//A record found in a page
+type hashRecord struct {
+	key []byte
+	id  int64
+}
+
+//Walk the records of page, stopping if f returns false
+func pageRecords(page []byte, f func(at int, r hashRecord) bool) {
+	used := int(binary.LittleEndian.Uint16(page[8:]))
+	for at := hashpageinfo; at < hashpageinfo+used; {
+		length := int(binary.LittleEndian.Uint16(page[at:]))
+		key := page[at+2 : at+2+length]
+		id := int64(binary.LittleEndian.Uint64(page[at+2+length:]))
+		if !f(at, hashRecord{key, id}) {
+			return
+		}
+		at += hashrecordinfo + length
+	}
+}
+
+//Find key in its bucket, giving the page, its offset and where the record is
+//in it, or -1 if not found
+func (h *hashIndex) find(r io.ReaderAt, state *hashState, key []byte) (page []byte, off int64, at int, err error) {
+	off = state.page(state.bucket(hashKey(key)))
+	for {
+		if page, err = readPage(r, off); err != nil {
+			return
+		}
+		at = -1
+		pageRecords(page, func(i int, rec hashRecord) bool {
+			if string(rec.key) == string(key) {
+				at = i
+				return false
+			}
+			return true
+		})
+		next := int64(binary.LittleEndian.Uint64(page))
+		if at >= 0 || next == 0 {
+			return
+		}
+		off = next
+	}
+}
+
+//Id of key
+func (h *hashIndex) Get(key []byte) (int64, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if !h.state.mayContain(hashKey(key)) {
+		return -1, ErrNotFound
+	}
+	page, _, at, err := h.find(h.store.view(), &h.state, key)
+	if err != nil {
+		return -1, err
+	}
+	if at < 0 {
+		return -1, ErrNotFound
+	}
+	return int64(binary.LittleEndian.Uint64(page[at+2+len(key):])), nil
+}
+
+//Map key to id, replacing the id it had if any
+func (h *hashIndex) Put(key []byte, id int64) error {
+	if len(key) > maxHashKeyLength {
+		return errors.New("Key is too long")
+	}
+	h.write.Lock()
+	defer h.write.Unlock()
+	sh := h.store.draft()
+	state := h.state
+	k := hashKey(key)
+	var off int64
+	var err error
+	at := -1 //Not there, for sure if the filter says so
+	if state.mayContain(k) {
+		if _, off, at, err = h.find(sh, &state, key); err != nil {
+			return err
+		}
+	}
+	if at >= 0 {
+		if err = NewInt64(id).Serialize(&SafeWriter{sh, off + int64(at+2+len(key))}); err != nil {
+			return err
+		}
+		return h.commit(sh, state)
+	}
+	if err = appendRecord(sh, state.page(state.bucket(k)), hashRecord{key, id}); err != nil {
+		return err
+	}
+	if f := state.filter(state.bucket(k)); f != nil {
+		f.bits = append([]byte(nil), f.bits...) //Readers use it until the switch
+		if err = f.add(sh, k); err != nil {
+			return err
+		}
+		state.rebuilt = append(state.rebuilt, *f)
+	}
+	state.count++
+	state.used += int64(hashrecordinfo + len(key))
+	if state.used > int64(hashInitial<<state.level+int(state.next))*hashPageLength*3/4 {
+		if err = split(sh, &state); err != nil {
+			return err
+		}
+	}
+	return h.commit(sh, state)
+}
+
+//Add rec to the bucket starting at off, in the first page with room for it
+func appendRecord(s BearStorage, off int64, rec hashRecord) error {
+	length := hashrecordinfo + len(rec.key)
+	for {
+		page, err := readPage(s, off)
+		if err != nil {
+			return err
+		}
+		used := int(binary.LittleEndian.Uint16(page[8:]))
+		if hashpageinfo+used+length <= hashPageLength {
+			buff := make([]byte, 2+length)
+			binary.LittleEndian.PutUint16(buff, uint16(used+length))
+			binary.LittleEndian.PutUint16(buff[2:], uint16(len(rec.key)))
+			copy(buff[4:], rec.key)
+			binary.LittleEndian.PutUint64(buff[4+len(rec.key):], uint64(rec.id))
+			if _, err = s.WriteAt(buff[:2], off+8); err != nil {
+				return err
+			}
+			_, err = s.WriteAt(buff[2:], off+int64(hashpageinfo+used))
+			return err
+		}
+		next := int64(binary.LittleEndian.Uint64(page))
+		if next == 0 { //Chain a new page
+			next = s.Size()
+			if _, err = s.WriteAt(make([]byte, hashPageLength), next); err != nil {
+				return err
+			}
+			if err = NewInt64(next).Serialize(&SafeWriter{s, off}); err != nil {
+				return err
+			}
+		}
+		off = next
+	}
+}
+
+//Split bucket next of state into itself and a new bucket
+func split(s BearStorage, state *hashState) error {
+	old := uint64(state.next)
+	added := old + hashInitial<<state.level
+	if j, _ := segment(added); state.segments[j] == 0 {
+		if err := state.allocate(s, j); err != nil {
+			return err
+		}
+	}
+	//Take the records out of the old bucket, emptying its pages
+	var records []hashRecord
+	for off := state.page(old); off != 0; {
+		page, err := readPage(s, off)
+		if err != nil {
+			return err
+		}
+		pageRecords(page, func(at int, rec hashRecord) bool {
+			records = append(records, rec)
+			return true
+		})
+		if _, err = s.WriteAt([]byte{0, 0}, off+8); err != nil {
+			return err
+		}
+		off = int64(binary.LittleEndian.Uint64(page))
+	}
+	//Build the filters of both buckets again aside, as readers use them
+	//until the split is committed
+	filters := make(map[uint64]*bloomFilter)
+	for _, b := range []uint64{old, added} {
+		if f := state.filter(b); f != nil {
+			filters[b] = &bloomFilter{f.off, f.hashes, make([]byte, len(f.bits))}
+		}
+	}
+	mask := uint64(hashInitial<<(state.level+1)) - 1
+	for _, rec := range records {
+		b, k := old, hashKey(rec.key)
+		if k&mask != old {
+			b = added
+		}
+		if err := appendRecord(s, state.page(b), rec); err != nil {
+			return err
+		}
+		if f := filters[b]; f != nil {
+			f.set(k)
+		}
+	}
+	for _, f := range filters {
+		if _, err := s.WriteAt(f.bits, f.off); err != nil {
+			return err
+		}
+		state.rebuilt = append(state.rebuilt, *f)
+	}
+	state.next++
+	if state.next == hashInitial<<state.level {
+		state.level++
+		state.next = 0
+	}
+	return nil
+}
+
+//Remove key
+func (h *hashIndex) Delete(key []byte) error {
+	h.write.Lock()
+	defer h.write.Unlock()
+	return h.remove(key, -1)
+}
+
+//Remove key, only if it maps to id unless id is negative. Must be the
+//writer.
+func (h *hashIndex) remove(key []byte, id int64) error {
+	if !h.state.mayContain(hashKey(key)) {
+		return ErrNotFound
+	}
+	sh := h.store.draft()
+	state := h.state
+	page, off, at, err := h.find(sh, &state, key)
+	if err != nil {
+		return err
+	}
+	if at < 0 || (id >= 0 && int64(binary.LittleEndian.Uint64(page[at+2+len(key):])) != id) {
+		return ErrNotFound
+	}
+	used := int(binary.LittleEndian.Uint16(page[8:]))
+	length := hashrecordinfo + len(key)
+	copy(page[at:], page[at+length:hashpageinfo+used])
+	binary.LittleEndian.PutUint16(page[8:], uint16(used-length))
+	if _, err = sh.WriteAt(page[8:hashpageinfo+used-length], off+8); err != nil {
+		return err
+	}
+	state.count--
+	state.used -= int64(length)
+	return h.commit(sh, state)
+}
+
+//Number of keys
+func (h *hashIndex) Len() int64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.state.count
+}
+
+//Sync the index. The storages belong to the caller and stay open.
+func (h *hashIndex) Close() error {
+	h.write.Lock()
+	defer h.write.Unlock()
+	return h.store.close()
+}
+
+//Map key to id, as an Index. A key maps to one id only, so inserting it
+//again replaces the id.
+func (h *hashIndex) Insert(key []byte, id int64) error {
+	return h.Put(key, id)
+}
+
+//Remove key if it maps to id, as an Index
+func (h *hashIndex) Remove(key []byte, id int64) error {
+	h.write.Lock()
+	defer h.write.Unlock()
+	if err := h.remove(key, id); err != ErrNotFound {
+		return err
+	}
+	return nil
+}
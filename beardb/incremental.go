@@ -0,0 +1,166 @@
+package beardb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+//Incremental backups
+/*=============================================================================
+A blackBearDB only grows, except for Modify, so the changes since the last
+backup are the bytes appended since and the ranges overwritten by Modify.
+
+Incremental backup stream:
+------------------------------------------------------------------------
+|magic|base int64|tail int64|count uint32|Range|...|appended|crc uint32|
+------------------------------------------------------------------------
+Base is the size at the last backup and tail the size at this one. Count
+Ranges of bytes before base follow, then the bytes from base to tail.
+Crc is the checksum of everything before it.
+
+Range:
+------------------------------
+|off int64|length uint32|data|
+------------------------------
+Tracking of modifications starts over with every backup and lives in memory
+only, so a chain must start with a full backup after the database is opened.
+=============================================================================*/
+const (
+	incrementalinfoLength = 28
+	incrementalRange      = 12
+	incrementalMagic      = "BEARINCR"
+)
+
+func incrementalBackup(lock *rwMutex, t *tracker, w io.Writer) (err error) {
+	b, err := startBackup(lock, t, true)
+	if err != nil {
+		return err
+	}
+	defer func() { endBackup(lock, t, b, err) }()
+	if b.base < 0 {
+		return errors.New("No backup to start from")
+	}
+
+	var s spans
+	for _, sp := range b.modified {
+		if sp.off >= b.base {
+			break
+		}
+		if sp.end > b.base {
+			sp.end = b.base
+		}
+		s = append(s, sp)
+	}
+	crc := crc32.NewIEEE()
+	mw := io.MultiWriter(w, crc)
+	header := make([]byte, incrementalinfoLength)
+	copy(header, incrementalMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(b.base))
+	binary.LittleEndian.PutUint64(header[16:], uint64(b.tail))
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(s)))
+	if _, err = mw.Write(header); err != nil {
+		return err
+	}
+	frame := func(sp span) error {
+		if sp.off >= b.base { //The appended bytes are not framed
+			return nil
+		}
+		head := make([]byte, incrementalRange)
+		binary.LittleEndian.PutUint64(head, uint64(sp.off))
+		binary.LittleEndian.PutUint32(head[8:], uint32(sp.end-sp.off))
+		_, err := mw.Write(head)
+		return err
+	}
+	if err = copySpans(lock, t, b, append(s, span{b.base, b.tail}), mw, frame); err != nil {
+		return err
+	}
+	trail := make([]byte, backupTrailLength)
+	binary.LittleEndian.PutUint32(trail, crc.Sum32())
+	_, err = w.Write(trail)
+	return err
+}
+
+//Apply an incremental backup stream to dst, which must hold the image of
+//the backup it follows. Dst is left unchanged if the stream is corrupt.
+func ApplyIncremental(r io.Reader, dst BearStorage) error {
+	crc := crc32.NewIEEE()
+	tr := io.TeeReader(r, crc)
+	header := make([]byte, incrementalinfoLength)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return err
+	}
+	if string(header[:8]) != incrementalMagic {
+		return errors.New("Not an incremental backup")
+	}
+	base := int64(binary.LittleEndian.Uint64(header[8:]))
+	tail := int64(binary.LittleEndian.Uint64(header[16:]))
+	if dst.Size() != base {
+		return errors.New("Incremental backup does not follow this image")
+	}
+	if tail < base {
+		return errors.New("Incremental backup is corrupted")
+	}
+
+	//Everything is staged until the checksum is verified. Ranges are sorted
+	//and apart, all before base, so they hold at most base bytes.
+	type patch struct {
+		off  int64
+		data []byte
+	}
+	var patches []patch
+	head := make([]byte, incrementalRange)
+	end := int64(0)
+	for i := binary.LittleEndian.Uint32(header[24:]); i > 0; i-- {
+		if _, err := io.ReadFull(tr, head); err != nil {
+			return err
+		}
+		off := int64(binary.LittleEndian.Uint64(head))
+		length := int64(binary.LittleEndian.Uint32(head[8:]))
+		if off < end || off > base || length > base-off {
+			return errors.New("Incremental backup is corrupted")
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(tr, data); err != nil {
+			return err
+		}
+		patches = append(patches, patch{off, data})
+		end = off + length
+	}
+	appended := NewKoala(0) //Grows with the bytes actually read
+	if _, err := io.CopyN(&SafeWriter{appended, 0}, tr, tail-base); err != nil {
+		return err
+	}
+	trail := make([]byte, backupTrailLength)
+	if _, err := io.ReadFull(r, trail); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(trail) != crc.Sum32() {
+		return errors.New("Incremental backup checksum mismatch")
+	}
+
+	if _, err := io.Copy(&SafeWriter{dst, base}, &SafeReader{appended, 0}); err != nil {
+		return err
+	}
+	for _, p := range patches {
+		if _, err := dst.WriteAt(p.data, p.off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Rebuild a database into dst from a full backup stream followed by the
+//incremental backups made after it, in order
+func RestoreChain(dst BearStorage, full io.Reader, incrementals ...io.Reader) error {
+	if err := RestoreBackup(full, dst); err != nil {
+		return err
+	}
+	for _, r := range incrementals {
+		if err := ApplyIncremental(r, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
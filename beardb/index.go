@@ -0,0 +1,270 @@
+package beardb
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+)
+
+//Secondary indexes
+/*=============================================================================
+An index registered on a brownBearDB holds (key, id) pairs for the entries of
+the bear, with the keys an Extractor gives for their data. Writers keep it up
+to date under the write lock: the pairs of a change are worked out before any
+write, the index is updated, and only then is the change written. If any
+update fails, those made are undone and nothing is written.
+
+The indexes live in storages of their own and are not part of the commit of
+the change, so a crash after an index is updated and before the change is
+durable leaves the index with keys of a change that never happened. After a
+crash, open each index on an empty storage and Rebuild it.
+
+Rebuild fills an index from the entries already there, so an index can be
+added to a bear at any time.
+
+Extractors read the item from the start of the data of the entry. Gob
+writers encode type information only with the first item they write, so on
+a bear with indexes they send it again with every entry, and GobExtractor
+decodes it with a new decoder. Entries a gob writer wrote before the bear had
+indexes may not be decodable on their own, and Rebuild fails on them.
+=============================================================================*/
+
+//What a gob decoder gives for type information it has already
+const errGobDuplicateType = "gob: duplicate type received"
+
+//Pairs of a key and an id. A bTree holds any number of ids for a key, a
+//hashIndex one.
+type Index interface {
+	Insert(key []byte, id int64) error
+	Remove(key []byte, id int64) error
+}
+
+//The keys of the item r reads from the start of the data of an entry. The
+//data may have padding after the item, which decoders ignore.
+type Extractor func(r io.Reader) ([][]byte, error)
+
+//An Extractor decoding the item into a Serializer from newItem and giving the
+//keys keys finds in it
+func SerializerExtractor(newItem func() Serializer, keys func(item Serializer) ([][]byte, error)) Extractor {
+	return func(r io.Reader) ([][]byte, error) {
+		item := newItem()
+		if err := item.Deserialize(r); err != nil {
+			return nil, err
+		}
+		return keys(item)
+	}
+}
+
+//An Extractor decoding the item gob encoded into what newItem returns, which
+//must be a pointer, and giving the keys keys finds in it
+func GobExtractor(newItem func() interface{}, keys func(item interface{}) ([][]byte, error)) Extractor {
+	return func(r io.Reader) ([][]byte, error) {
+		item := newItem()
+		if err := gob.NewDecoder(r).Decode(item); err != nil {
+			return nil, err
+		}
+		return keys(item)
+	}
+}
+
+//Decode items one after another with d
+func decodeGob(d *gob.Decoder, items []interface{}) error {
+	for _, item := range items {
+		if err := d.Decode(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type secondaryIndex struct {
+	index   Index
+	extract Extractor
+}
+
+//An update to an index
+type indexUpdate struct {
+	index  Index
+	key    []byte
+	id     int64
+	insert bool
+}
+
+func (u *indexUpdate) do(insert bool) error {
+	if insert {
+		return u.index.Insert(u.key, u.id)
+	}
+	return u.index.Remove(u.key, u.id)
+}
+
+//Keep ix holding the keys extract gives for every entry from now on. Call
+//Rebuild for the entries already there.
+func (db *brownBearDB) IndexBy(ix Index, extract Extractor) error {
+	if err := db.lock(context.Background()); err != nil {
+		return err
+	}
+	defer db.rwlock.Unlock()
+	for _, si := range db.indexes {
+		if si.index == ix {
+			return errors.New("Index is already registered")
+		}
+	}
+	db.indexes = append(db.indexes, secondaryIndex{ix, extract})
+	return nil
+}
+
+//Whether any index is registered. Must hold the lock.
+func (db *brownBearDB) indexed() bool {
+	return len(db.indexes) > 0
+}
+
+//Data of the entry at id in s if any index needs it. Must hold the write
+//lock.
+func (db *brownBearDB) indexedData(s BearStorage, id int64) ([]byte, error) {
+	if len(db.indexes) == 0 {
+		return nil, nil
+	}
+	return db.entryData(s, id)
+}
+
+//Updates moving the entry at id from the keys of old to those of data, nil
+//for none. Keys in both are left alone.
+func (db *brownBearDB) indexUpdates(id int64, old, data []byte) ([]indexUpdate, error) {
+	var updates []indexUpdate
+	for _, si := range db.indexes {
+		var before, after [][]byte
+		var err error
+		if old != nil {
+			if before, err = si.extract(bytes.NewReader(old)); err != nil {
+				return nil, err
+			}
+		}
+		if data != nil {
+			if after, err = si.extract(bytes.NewReader(data)); err != nil {
+				return nil, err
+			}
+		}
+		kept := make(map[string]bool)
+		for _, key := range before {
+			kept[string(key)] = true
+		}
+		for _, key := range after {
+			if kept[string(key)] {
+				kept[string(key)] = false
+			} else {
+				updates = append(updates, indexUpdate{si.index, key, id, true})
+			}
+		}
+		for _, key := range before {
+			if kept[string(key)] {
+				updates = append(updates, indexUpdate{si.index, key, id, false})
+				kept[string(key)] = false
+			}
+		}
+	}
+	return updates, nil
+}
+
+//Make updates, undoing those made if one fails
+func updateIndexes(updates []indexUpdate) error {
+	for i := range updates {
+		if err := updates[i].do(updates[i].insert); err != nil {
+			undoIndexes(updates[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+//Undo updates made, last first. Errors are ignored, as there is already one
+//to report.
+func undoIndexes(updates []indexUpdate) {
+	for i := len(updates) - 1; i >= 0; i-- {
+		updates[i].do(!updates[i].insert)
+	}
+}
+
+//Insert the keys of every entry of the bear into ix, which must be
+//registered and should be empty. The bear is scanned under the write lock,
+//so ix is complete when Rebuild returns. If it fails, ix is left with some
+//of the keys.
+func (db *brownBearDB) Rebuild(ix Index) error {
+	return db.RebuildContext(context.Background(), ix)
+}
+
+//Same as Rebuild, giving up once ctx is done
+func (db *brownBearDB) RebuildContext(ctx context.Context, ix Index) error {
+	if err := db.lock(ctx); err != nil {
+		return err
+	}
+	defer db.rwlock.Unlock()
+	var extract Extractor
+	for _, si := range db.indexes {
+		if si.index == ix {
+			extract = si.extract
+		}
+	}
+	if extract == nil {
+		return errors.New("Index is not registered")
+	}
+
+	//Copies kept for snapshots and areas entries jump to are not entries
+	skip := make(map[int64]bool)
+	for _, vs := range db.versions {
+		for _, v := range vs {
+			skip[v.loc] = true
+		}
+	}
+	err := db.scan(ctx, func(off int64, info *datainfo, r *SafeReader) error {
+		if !info.IsDeleted() && info.IsLongJump() && !db.versioned {
+			loc := new(Int64)
+			if err := loc.Deserialize(r); err != nil {
+				return err
+			}
+			skip[loc.Get()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.scan(ctx, func(off int64, info *datainfo, r *SafeReader) error {
+		if info.IsDeleted() || skip[off] || (db.versioned && !info.IsLongJump()) {
+			return nil
+		}
+		data, err := db.entryData(db.storage, off)
+		if err != nil {
+			return err
+		}
+		keys, err := extract(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = ix.Insert(key, off); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//Call f with every entry in the storage, in order, with r at its data. Must
+//hold the lock.
+func (db *brownBearDB) scan(ctx context.Context, f func(off int64, info *datainfo, r *SafeReader) error) error {
+	size := db.size()
+	r := &SafeReader{readerContext(ctx, db.storage), 0}
+	info := new(datainfo)
+	for off := int64(0); off < size; off += datainfoLength + int64(info.GetLength()) {
+		r.Offset = off
+		if err := info.ReadFrom(r); err != nil {
+			return err
+		}
+		if err := f(off, info, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package beardb
+
+import (
+	"fmt"
+	"testing"
+)
+
+//Keys of Int64 items
+var int64Keys = SerializerExtractor(
+	func() Serializer { return new(Int64) },
+	func(item Serializer) ([][]byte, error) { return [][]byte{Int64Key(item.(*Int64).Get())}, nil },
+)
+
+//Every item is decoded on its own, not only the first of a writer
+func TestIndexExtractor(t *testing.T) {
+	db := NewBrownBearDB(NewKoala(0))
+	tr, err := NewBTree(NewKoala(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.IndexBy(tr, int64Keys); err != nil {
+		t.Fatal(err)
+	}
+	w := db.NewSerializerWriter()
+	ids := make(map[int64]int64)
+	for i := int64(0); i < 50; i++ {
+		if ids[i], err = w.AddItem(NewInt64(i * 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Modify(ids[7], NewInt64(-1)); err != nil {
+		t.Fatal(err)
+	}
+	var got []int64
+	it := tr.Range(Int64Key(60), Int64Key(100))
+	for it.Next() {
+		got = append(got, it.ID())
+	}
+	if err = it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{ids[6], ids[8], ids[9]}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("ids of 60 to 100 are %v, want %v", got, want)
+	}
+}
+
+type gobIndexed struct {
+	Key  int64
+	Name string
+}
+
+//Keys of gobIndexed items
+var gobKeys = GobExtractor(
+	func() interface{} { return new(gobIndexed) },
+	func(item interface{}) ([][]byte, error) { return [][]byte{Int64Key(item.(*gobIndexed).Key)}, nil },
+)
+
+//Ids of the keys from from up to to in tr
+func rangeIDs(t *testing.T, tr *bTree, from, to int64) []int64 {
+	var got []int64
+	it := tr.Range(Int64Key(from), Int64Key(to))
+	for it.Next() {
+		got = append(got, it.ID())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+//Gob writers keep indexes up to date, and what they write to an indexed bear
+//can still be read
+func TestIndexGob(t *testing.T) {
+	db := NewVersionedBrownBearDB(NewKoala(0), 0)
+	if err := db.SetWAL(NewKoala(0)); err != nil {
+		t.Fatal(err)
+	}
+	w := db.NewGobWriter()
+	first, err := w.AddItem(gobIndexed{-1, "before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewBTree(NewKoala(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.IndexBy(tr, gobKeys); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int64]int64)
+	for i := int64(0); i < 20; i++ {
+		if ids[i], err = w.AddItem(gobIndexed{i * 10, fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Modify(ids[7], gobIndexed{-7, "modified"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.ModifyIf(ids[8], 1, gobIndexed{-8, "modified if"}); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.ModifyTx(tx, ids[9], gobIndexed{-9, "in a tx"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rangeIDs(t, tr, 60, 100), []int64{ids[6]}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("ids of 60 to 100 are %v, want %v", got, want)
+	}
+	if got, want := rangeIDs(t, tr, -9, -6), []int64{ids[9], ids[8], ids[7]}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("ids of -9 to -6 are %v, want %v", got, want)
+	}
+
+	//One reader decodes entries written before and after the index
+	r := db.NewGobReader()
+	for _, id := range []int64{first, ids[3], ids[7], first, ids[4]} {
+		var item gobIndexed
+		if err = r.GetItem(id, &item); err != nil {
+			t.Fatalf("reading %d: %v", id, err)
+		}
+	}
+	var item gobIndexed
+	if err = r.GetItem(ids[9], &item); err != nil || item.Name != "in a tx" {
+		t.Fatalf("item modified in a tx is %v, %v", item, err)
+	}
+}
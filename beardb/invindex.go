@@ -0,0 +1,298 @@
+package beardb
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+//Inverted index
+/*=============================================================================
+An invertedIndex finds the ids of entries holding words. Text is cut into
+lower-case terms by Tokenize, and the ids of every term are kept in a chain
+of blocks in a BearStorage, with a hashIndex leading from the term to the
+first block of its chain:
+
+Postings:
+-----------------
+|magic|Block...|
+-----------------
+Block:
+--------------------------------------------
+|next int64|count uint16|id int64 x count|
+--------------------------------------------
+Next is the block after it, 0 for the last one. A new id goes into the first
+block, or a new block put in front of it when it is full. A block is written
+before the dictionary points to it, so a crash can at most leave a block
+nothing points to. Like a hashIndex, changes are logged to a journal if one
+is given.
+
+It is an Index of terms, to be kept with the entries of a brownBearDB through
+an Extractor from TextExtractor. A pair added twice is there twice, queries
+give its id once and Remove takes out both.
+=============================================================================*/
+const (
+	postingsinfoLength = 8
+	postingsMagic      = "BEARPOST"
+	postingBlockLength = 512
+	postingblockinfo   = 10
+	postingBlockIDs    = (postingBlockLength - postingblockinfo) / 8
+)
+
+//Cut text into terms: lower-case runs of letters and digits, each given once
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	seen := make(map[string]bool)
+	terms := words[:0]
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+//An Extractor decoding the item into a Serializer from newItem and giving the
+//terms of the text text finds in it
+func TextExtractor(newItem func() Serializer, text func(item Serializer) string) Extractor {
+	return SerializerExtractor(newItem, func(item Serializer) ([][]byte, error) {
+		terms := Tokenize(text(item))
+		keys := make([][]byte, len(terms))
+		for i, term := range terms {
+			keys[i] = []byte(term)
+		}
+		return keys, nil
+	})
+}
+
+type postingBlock struct {
+	next int64
+	ids  []int64
+}
+
+func readBlock(r io.ReaderAt, off int64) (*postingBlock, error) {
+	buff := make([]byte, postingBlockLength)
+	if _, err := r.ReadAt(buff, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	b := &postingBlock{next: int64(binary.LittleEndian.Uint64(buff))}
+	count := int(binary.LittleEndian.Uint16(buff[8:]))
+	if count > postingBlockIDs {
+		return nil, errors.New("Postings are corrupted")
+	}
+	b.ids = make([]int64, count)
+	for i := range b.ids {
+		b.ids[i] = int64(binary.LittleEndian.Uint64(buff[postingblockinfo+8*i:]))
+	}
+	return b, nil
+}
+
+func (b *postingBlock) encode() []byte {
+	buff := make([]byte, postingBlockLength)
+	binary.LittleEndian.PutUint64(buff, uint64(b.next))
+	binary.LittleEndian.PutUint16(buff[8:], uint16(len(b.ids)))
+	for i, id := range b.ids {
+		binary.LittleEndian.PutUint64(buff[postingblockinfo+8*i:], uint64(id))
+	}
+	return buff
+}
+
+type invertedIndex struct {
+	store *indexStorage
+	dict  *hashIndex //Term to its first block
+	lock  sync.RWMutex
+}
+
+//Open the inverted index with postings in s, creating it if s is empty, and
+//the terms in dict. Changes to s are logged to journal first if it is not
+//nil, and a change cut short by a crash is completed here.
+func NewInvertedIndex(s BearStorage, journal BearStorage, dict *hashIndex) (*invertedIndex, error) {
+	store, err := openIndexStorage(s, journal, nil)
+	if err != nil {
+		return nil, err
+	}
+	ix := &invertedIndex{store: store, dict: dict}
+	if s.Size() == 0 {
+		sh := &shadow{base: s}
+		if _, err := sh.WriteAt([]byte(postingsMagic), 0); err != nil {
+			return nil, err
+		}
+		if err := store.change(sh.writes, func() {}); err != nil {
+			return nil, err
+		}
+		return ix, nil
+	}
+	magic := make([]byte, postingsinfoLength)
+	if _, err := s.ReadAt(magic, 0); err != nil {
+		return nil, err
+	}
+	if string(magic) != postingsMagic {
+		return nil, errors.New("Not postings")
+	}
+	return ix, nil
+}
+
+//First block of term, 0 if it has none
+func (ix *invertedIndex) head(term []byte) (int64, error) {
+	head, err := ix.dict.Get(term)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	return head, err
+}
+
+//Add id to the postings of term
+func (ix *invertedIndex) Insert(term []byte, id int64) error {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	head, err := ix.head(term)
+	if err != nil {
+		return err
+	}
+	sh := ix.store.draft()
+	if head != 0 {
+		b, err := readBlock(sh, head)
+		if err != nil {
+			return err
+		}
+		if len(b.ids) < postingBlockIDs {
+			b.ids = append(b.ids, id)
+			if _, err = sh.WriteAt(b.encode(), head); err != nil {
+				return err
+			}
+			return ix.store.change(sh.writes, func() {})
+		}
+	}
+	b := &postingBlock{next: head, ids: []int64{id}}
+	off := sh.Size()
+	if _, err = sh.WriteAt(b.encode(), off); err != nil {
+		return err
+	}
+	if err = ix.store.change(sh.writes, func() {}); err != nil {
+		return err
+	}
+	return ix.dict.Put(term, off)
+}
+
+//Take id out of the postings of term
+func (ix *invertedIndex) Remove(term []byte, id int64) error {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	off, err := ix.head(term)
+	if err != nil {
+		return err
+	}
+	sh := ix.store.draft()
+	for off != 0 {
+		b, err := readBlock(sh, off)
+		if err != nil {
+			return err
+		}
+		ids := b.ids[:0]
+		for _, i := range b.ids {
+			if i != id {
+				ids = append(ids, i)
+			}
+		}
+		if len(ids) != len(b.ids) {
+			b.ids = ids
+			if _, err = sh.WriteAt(b.encode(), off); err != nil {
+				return err
+			}
+		}
+		off = b.next
+	}
+	return ix.store.change(sh.writes, func() {})
+}
+
+//Ids in the postings of term. Must hold the lock.
+func (ix *invertedIndex) postings(term string) (map[int64]bool, error) {
+	off, err := ix.head([]byte(term))
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[int64]bool)
+	for off != 0 {
+		b, err := readBlock(ix.store.view(), off)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range b.ids {
+			ids[id] = true
+		}
+		off = b.next
+	}
+	return ids, nil
+}
+
+func sortedIDs(set map[int64]bool) []int64 {
+	ids := make([]int64, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+//Query terms cut by Tokenize, the way the text was, so "Apple" finds
+//"apple" and "red apple" is two terms
+func queryTerms(terms []string) []string {
+	return Tokenize(strings.Join(terms, " "))
+}
+
+//Ids of the entries holding all terms, in order
+func (ix *invertedIndex) And(terms ...string) ([]int64, error) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	var result map[int64]bool
+	for _, term := range queryTerms(terms) {
+		ids, err := ix.postings(term)
+		if err != nil {
+			return nil, err
+		}
+		if result != nil {
+			for id := range result {
+				if !ids[id] {
+					delete(result, id)
+				}
+			}
+		} else {
+			result = ids
+		}
+		if len(result) == 0 {
+			break
+		}
+	}
+	return sortedIDs(result), nil
+}
+
+//Ids of the entries holding any of terms, in order
+func (ix *invertedIndex) Or(terms ...string) ([]int64, error) {
+	ix.lock.RLock()
+	defer ix.lock.RUnlock()
+	result := make(map[int64]bool)
+	for _, term := range queryTerms(terms) {
+		ids, err := ix.postings(term)
+		if err != nil {
+			return nil, err
+		}
+		for id := range ids {
+			result[id] = true
+		}
+	}
+	return sortedIDs(result), nil
+}
+
+//Sync the postings. The storages and dict belong to the caller and stay open.
+func (ix *invertedIndex) Close() error {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	return ix.store.close()
+}
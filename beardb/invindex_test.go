@@ -0,0 +1,56 @@
+package beardb
+
+import (
+	"fmt"
+	"testing"
+)
+
+//Terms of String items
+var stringTerms = TextExtractor(
+	func() Serializer { return new(String) },
+	func(item Serializer) string { return item.(*String).Get() },
+)
+
+//Queries are cut into terms the way the text is
+func TestInvertedIndexQueryCase(t *testing.T) {
+	db := NewBrownBearDB(NewKoala(0))
+	dict, err := NewHashIndex(NewKoala(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := NewInvertedIndex(NewKoala(0), nil, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.IndexBy(ix, stringTerms)
+	w := db.NewSerializerWriter()
+	pie, err := w.AddItem(NewString("Red Apple pie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	juice, err := w.AddItem(NewString("apple JUICE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []struct {
+		query []string
+		and   []int64
+		or    []int64
+	}{
+		{[]string{"Apple"}, []int64{pie, juice}, []int64{pie, juice}},
+		{[]string{"APPLE", "Pie"}, []int64{pie}, []int64{pie, juice}},
+		{[]string{"red apple"}, []int64{pie}, []int64{pie, juice}},
+		{[]string{"Juice!", "pie"}, nil, []int64{pie, juice}},
+		{[]string{"?"}, nil, nil},
+	} {
+		got, err := ix.And(q.query...)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(q.and) {
+			t.Errorf("And(%q) = %v, %v, want %v", q.query, got, err, q.and)
+		}
+		got, err = ix.Or(q.query...)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(q.or) {
+			t.Errorf("Or(%q) = %v, %v, want %v", q.query, got, err, q.or)
+		}
+	}
+}
@@ -2,85 +2,150 @@ package beardb
 
 import (
 	"errors"
-	"os"
+	"io"
+	"sync"
 )
 
-type koala []byte
+//In-memory storage behaving like a file
+type koala struct {
+	data   []byte
+	frozen int64 //Length of the prefix of data shared with a frozen image
+	lock   sync.RWMutex
+}
 
 func NewKoala(size int) *koala {
-	k := make(koala, 0, size)
-	return &k
+	return &koala{data: make([]byte, 0, size)}
 }
 
-func (k *koala) WriteAt(p []byte, off int64) (n int, err error) {
-	if len(*k)-int(off) >= len(p) { //Enough space to write
-		n = copy((*k)[off:], p)
-		if n < len(p) {
-			err = errors.New("Koala Copy error")
+//Grow data to size, zero-filling. Must hold the write lock.
+func (k *koala) grow(size int64) {
+	old := int64(len(k.data))
+	if size <= int64(cap(k.data)) {
+		k.data = k.data[:size]
+		for i := old; i < size; i++ { //May hold bytes from before a shrink
+			k.data[i] = 0
 		}
 	} else {
-		*k = append((*k)[:off], p...)
-		n = len(p)
+		capacity := 2 * int64(cap(k.data))
+		if capacity < size {
+			capacity = size
+		}
+		data := make([]byte, size, capacity)
+		copy(data, k.data)
+		k.data = data
+		k.frozen = 0
 	}
-	return
+}
+
+//Copy data away from a frozen image before changing bytes in it. Must hold
+//the write lock.
+func (k *koala) unshare() {
+	if k.frozen > 0 {
+		k.data = append(make([]byte, 0, cap(k.data)), k.data...)
+		k.frozen = 0
+	}
+}
+
+//Appending past the frozen prefix leaves it intact, so only writes inside it
+//pay for a copy
+func (k *koala) freeze() []byte {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.frozen = int64(len(k.data))
+	return k.data[:len(k.data):len(k.data)]
+}
+
+func (k *koala) WriteAt(p []byte, off int64) (n int, err error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off < k.frozen {
+		k.unshare()
+	}
+	if end := off + int64(len(p)); end > int64(len(k.data)) {
+		k.grow(end)
+	}
+	return copy(k.data[off:], p), nil
 }
 
 func (k *koala) ReadAt(p []byte, off int64) (n int, err error) {
-	n = copy(p, (*k)[off:])
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off < int64(len(k.data)) {
+		n = copy(p, k.data[off:])
+	}
 	if n < len(p) {
-		err = errors.New("Insufficient bytes")
+		err = io.EOF
 	}
 	return
 }
 
 func (k *koala) Close() error {
-	*k = nil
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.data = nil
 	return nil
 }
 
 func (k *koala) Size() int64 {
-	return int64(len(*k))
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return int64(len(k.data))
 }
 
 func (k *koala) Truncate(size int64) error {
-	if size <= k.Size() { //Shrink
-		*k = (*k)[:size]
-		return nil
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if size < 0 {
+		return errors.New("Negative size")
+	}
+	if size < k.frozen { //Growing again would zero frozen bytes
+		k.unshare()
+	}
+	if size <= int64(len(k.data)) { //Shrink
+		k.data = k.data[:size]
 	} else {
-		empty := make([]byte, int(size-k.Size()))
-		*k = append(*k, empty...)
-		return nil
+		k.grow(size)
 	}
+	return nil
 }
 
 //Trim the koala cap to at most len+margin
 func (k *koala) Trim(margin int) {
-	if len(*k)+margin < cap(*k) {
-		*k = append(koala(nil), (*k)[:len(*k)+margin]...)[:len(*k)]
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if len(k.data)+margin < cap(k.data) {
+		k.data = append([]byte(nil), k.data[:len(k.data)+margin]...)[:len(k.data)]
+		k.frozen = 0
 	}
 }
 
+//Atomically write a checkpoint of the koala to path. Writers are not blocked
+//while it is being written.
 func (k *koala) ToFile(path string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	_, err = file.Write([]byte(*k))
-	return err
+	return writeCheckpoint(path, k.freeze(), 0)
 }
 
+//Replace the content with the checkpoint at path
 func (k *koala) FromFile(path string) error {
-	file, err := os.Open(path)
+	image, _, err := readCheckpoint(path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	fi, err := file.Stat()
-	if err != nil {
-		return err
-	}
-	*k = make(koala, fi.Size())
-	_, err = file.Read([]byte(*k))
-	return err
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.data = image
+	k.frozen = 0
+	return nil
 }
@@ -0,0 +1,138 @@
+package beardb
+
+import (
+	"context"
+	"errors"
+)
+
+//Key-value
+/*=============================================================================
+A bearKV stores items of a brownBearDB under string keys. The keys are kept
+in a hashIndex in a storage of its own, which grows a bucket at a time with
+the keys, so finding the id of a key stays O(1) however many there are.
+The Bloom filter of each bucket answers most lookups of missing keys without
+reading the bucket, and a missing key never costs a read of the items.
+
+A key is put into the index only once its item is written, and taken out
+before its item is deleted, so a crash can at most leave an item no key
+points to.
+=============================================================================*/
+var ErrNotFound = errors.New("Key not found")
+
+type bearKV struct {
+	db    *brownBearDB
+	index *hashIndex
+	lock  rwMutex
+}
+
+//Store items of db by key, with the keys in index. Changes to index are
+//logged to journal first if it is not nil. A new index has Bloom filters
+//with a false positive rate of 1%.
+func NewBearKV(db *brownBearDB, index BearStorage, journal BearStorage) (*bearKV, error) {
+	return NewFilteredBearKV(db, index, journal, defaultFalsePositiveRate)
+}
+
+//Same as NewBearKV, with Bloom filters of false positive rate rate for a new
+//index, or none if it is 0
+func NewFilteredBearKV(db *brownBearDB, index BearStorage, journal BearStorage, rate float64) (*bearKV, error) {
+	h, err := NewFilteredHashIndex(index, journal, rate)
+	if err != nil {
+		return nil, err
+	}
+	return &bearKV{db: db, index: h}, nil
+}
+
+//Id of the item at key
+func (kv *bearKV) ID(key string) (int64, error) {
+	return kv.IDContext(context.Background(), key)
+}
+
+//Same as ID, giving up once ctx is done
+func (kv *bearKV) IDContext(ctx context.Context, key string) (int64, error) {
+	if err := lockContext(ctx, kv.lock.RLocker()); err != nil {
+		return -1, err
+	}
+	defer kv.lock.RUnlock()
+	return kv.index.Get([]byte(key))
+}
+
+//Store item at key, replacing the item there if any
+func (kv *bearKV) Put(key string, item Serializer) error {
+	return kv.PutContext(context.Background(), key, item)
+}
+
+//Same as Put, giving up once ctx is done
+func (kv *bearKV) PutContext(ctx context.Context, key string, item Serializer) error {
+	if err := lockContext(ctx, &kv.lock); err != nil {
+		return err
+	}
+	defer kv.lock.Unlock()
+	w := kv.db.NewSerializerWriter()
+	id, err := kv.index.Get([]byte(key))
+	if err == nil {
+		return w.ModifyContext(ctx, id, item)
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	if id, err = w.AddItemContext(ctx, item); err != nil {
+		return err
+	}
+	return kv.index.Put([]byte(key), id)
+}
+
+//Get the item at key
+func (kv *bearKV) Get(key string, item Serializer) error {
+	return kv.GetContext(context.Background(), key, item)
+}
+
+//Same as Get, giving up once ctx is done
+func (kv *bearKV) GetContext(ctx context.Context, key string, item Serializer) error {
+	if err := lockContext(ctx, kv.lock.RLocker()); err != nil {
+		return err
+	}
+	defer kv.lock.RUnlock()
+	id, err := kv.index.Get([]byte(key))
+	if err != nil {
+		return err
+	}
+	return kv.db.NewSerializerReader().GetItemContext(ctx, id, item)
+}
+
+//Delete key and its item
+func (kv *bearKV) Delete(key string) error {
+	return kv.DeleteContext(context.Background(), key)
+}
+
+//Same as Delete, giving up once ctx is done
+func (kv *bearKV) DeleteContext(ctx context.Context, key string) error {
+	if err := lockContext(ctx, &kv.lock); err != nil {
+		return err
+	}
+	defer kv.lock.Unlock()
+	id, err := kv.index.Get([]byte(key))
+	if err != nil {
+		return err
+	}
+	if err = kv.index.Delete([]byte(key)); err != nil {
+		return err
+	}
+	return kv.db.DeleteContext(ctx, id)
+}
+
+//Number of keys
+func (kv *bearKV) Len() int64 {
+	return kv.index.Len()
+}
+
+//Sync the index. The storages belong to the caller and stay open.
+func (kv *bearKV) Close() error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	return kv.index.Close()
+}
+
+//Get the underlying DB
+func (kv *bearKV) GetDB() *brownBearDB {
+	return kv.db
+}
@@ -1,9 +1,13 @@
 package beardb
 
 import (
+	"errors"
 	"io"
+	"sync"
 )
 
+var ErrClosed = errors.New("Database is closed")
+
 //The abstract underlying storage for bearDBs
 type BearStorage interface {
 	io.WriterAt
@@ -13,6 +17,16 @@ type BearStorage interface {
 	Size() int64 //Return the current Offset
 }
 
+//Sync s to disk, if it can be
+func syncStorage(s BearStorage) error {
+	if s, ok := s.(interface {
+		Sync() error
+	}); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
 //Wrap an io.WriterAt to a threadsafe io.Writer
 //=============================================================================
 type SafeWriter struct {
@@ -39,6 +53,15 @@ func (o *SafeReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+//Being an io.ByteReader stops gob from buffering ahead of Offset
+func (o *SafeReader) ReadByte() (byte, error) {
+	p := make([]byte, 1)
+	if n, err := o.Read(p); n == 0 {
+		return 0, err
+	}
+	return p[0], nil
+}
+
 //Wrap an ReadWriterAt to a threadsafe io.ReadWriter
 //=============================================================================
 type ReadWriterAt interface {
@@ -57,12 +80,46 @@ func (o *SafeReadWriter) Read(p []byte) (n int, err error) {
 	return
 }
 
+func (o *SafeReadWriter) ReadByte() (byte, error) {
+	p := make([]byte, 1)
+	if n, err := o.Read(p); n == 0 {
+		return 0, err
+	}
+	return p[0], nil
+}
+
 func (i *SafeReadWriter) Write(p []byte) (n int, err error) {
 	n, err = i.WriteAt(p, i.Offset)
 	i.Offset += int64(n)
 	return
 }
 
+//Wakes up every waiter at once
+//=============================================================================
+type broadcast struct {
+	ch   chan struct{}
+	lock sync.Mutex
+}
+
+//The returned channel is closed on the next notify
+func (b *broadcast) wait() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.ch == nil {
+		b.ch = make(chan struct{})
+	}
+	return b.ch
+}
+
+func (b *broadcast) notify() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.ch != nil {
+		close(b.ch)
+		b.ch = nil
+	}
+}
+
 //Serializer API
 //=============================================================================
 //Serialize writes serialized bytes to io.Writer and returns any error
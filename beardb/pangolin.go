@@ -0,0 +1,414 @@
+package beardb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+//Data Structures
+/*=============================================================================
+Pangolin is an encrypting wrapper over another BearStorage. The underlying
+storage starts with a header, followed by slots.
+
+Header:
+-------------------------------------------
+|magic|blocksize uint32|unused|Size|Size|
+-------------------------------------------
+Size:
+-------------------------------------------
+|nonce|encrypted seq uint64|size int64|tag|
+-------------------------------------------
+Slot:
+------------------------------------------------
+|nonce|encrypted seq uint64|encrypted block|tag|
+------------------------------------------------
+The logical content is cut into blocks of blocksize bytes, and block i is
+sealed with AES-GCM into one of the two slots of block i, which start at
+pangolininfoLength + 2 * i * slot length.
+Every write seals the block again under a fresh random nonce, with a seq one
+more than that of the version in force, into the slot not holding it: the
+first slot for odd seqs and the second for even ones. The valid slot with the
+greater seq is in force, so a write torn by a crash leaves the version before
+it in force. The block number is authenticated along with the block, so slots
+cannot be swapped. Blocks are always sealed whole, the last one padded with
+zeros. The seq in force of a block is read from both of its slots the first
+time the block is used, and kept in memory after.
+
+The logical size is sealed too, in the two Size records of the header by
+turns, and the one with the greater seq is in force. A change of size is
+written after the blocks when growing and before cutting the storage when
+shrinking, so a crash at any point leaves a record which the slots cover.
+Slots missing below the size are found on open.
+=============================================================================*/
+const (
+	pangolinheadLength = 16
+	pangolinsizeLength = pangolinNonce + 16 + 16
+	pangolininfoLength = pangolinheadLength + 2*pangolinsizeLength
+	pangolinNonce      = 12
+	pangolinOverhead   = pangolinNonce + 16
+	pangolinSeqLength  = 8
+	pangolinMagic      = "BEARPANG"
+	pangolinSizeBlock  = ^uint64(0) //Associated data of the Size records
+)
+
+type pangolin struct {
+	storage   BearStorage
+	aead      cipher.AEAD
+	blocksize int64
+	size      int64            //Logical size
+	seq       uint64           //Of the Size record in force
+	seqs      map[int64]uint64 //Block -> seq in force once known, 0 for none
+	cached    int64            //Number of the block in cache, -1 if none
+	cache     []byte
+	lock      sync.Mutex
+}
+
+//Wrap s into an encrypting storage using key, which must be 16, 24 or 32
+//bytes to select AES-128, AES-192 or AES-256. If s is empty, a new pangolin
+//of blocksize bytes per block is created, otherwise blocksize is read from s.
+func NewPangolin(s BearStorage, key []byte, blocksize int) (*pangolin, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	p := &pangolin{storage: s, aead: aead, seqs: make(map[int64]uint64), cached: -1}
+
+	header := make([]byte, pangolininfoLength)
+	if s.Size() == 0 {
+		if blocksize <= 0 {
+			return nil, errors.New("Invalid block size")
+		}
+		copy(header, pangolinMagic)
+		binary.LittleEndian.PutUint32(header[8:], uint32(blocksize))
+		if _, err = s.WriteAt(header[:pangolinheadLength], 0); err != nil {
+			return nil, err
+		}
+		p.blocksize = int64(blocksize)
+		return p, p.writeSize()
+	}
+
+	if _, err = s.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(header[:8]) != pangolinMagic {
+		return nil, errors.New("Not a pangolin storage")
+	}
+	p.blocksize = int64(binary.LittleEndian.Uint32(header[8:]))
+	if p.blocksize <= 0 {
+		return nil, errors.New("Invalid block size")
+	}
+	found := false
+	for i := 0; i < 2; i++ {
+		sealed := header[pangolinheadLength+i*pangolinsizeLength:][:pangolinsizeLength]
+		plain, err := p.open(pangolinSizeBlock, sealed)
+		if err != nil {
+			continue
+		}
+		if seq := binary.LittleEndian.Uint64(plain); !found || seq > p.seq {
+			p.seq, p.size, found = seq, int64(binary.LittleEndian.Uint64(plain[8:])), true
+		}
+	}
+	if !found {
+		return nil, errors.New("Pangolin size is corrupted")
+	}
+	if p.size < 0 || s.Size() < p.slot(p.blocks()-1, 2) { //Up to the first slot of the last block
+		return nil, errors.New("Pangolin storage is truncated")
+	}
+	return p, nil
+}
+
+//Length of a slot
+func (p *pangolin) slotLength() int64 {
+	return pangolinSeqLength + p.blocksize + pangolinOverhead
+}
+
+//Offset of the slot of block holding seq
+func (p *pangolin) slot(block int64, seq uint64) int64 {
+	return pangolininfoLength + (2*block+int64(1-seq%2))*p.slotLength()
+}
+
+//Number of blocks under the current size
+func (p *pangolin) blocks() int64 {
+	return (p.size + p.blocksize - 1) / p.blocksize
+}
+
+//Logical length of block under the current size
+func (p *pangolin) length(block int64) int64 {
+	length := p.size - block*p.blocksize
+	if length > p.blocksize {
+		return p.blocksize
+	}
+	if length < 0 {
+		return 0
+	}
+	return length
+}
+
+//Encrypt plain with block as associated data, behind a fresh nonce
+func (p *pangolin) sealed(block uint64, plain []byte) ([]byte, error) {
+	sealed := make([]byte, pangolinNonce, len(plain)+pangolinOverhead)
+	if _, err := io.ReadFull(rand.Reader, sealed); err != nil {
+		return nil, err
+	}
+	ad := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ad, block)
+	return p.aead.Seal(sealed, sealed[:pangolinNonce], plain, ad), nil
+}
+
+//Decrypt what sealed made with block as associated data
+func (p *pangolin) open(block uint64, sealed []byte) ([]byte, error) {
+	ad := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ad, block)
+	return p.aead.Open(nil, sealed[:pangolinNonce], sealed[pangolinNonce:], ad)
+}
+
+//Read both slots of block and open the one in force, giving its seq and
+//content, or 0 and nil if neither opens
+func (p *pangolin) current(block int64) (uint64, []byte, error) {
+	first := p.slot(block, 1)
+	slots := make([]byte, 2*p.slotLength())
+	if _, err := p.storage.ReadAt(slots, first); err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	var seq uint64
+	var plain []byte
+	for _, parity := range []uint64{1, 2} {
+		at := p.slot(block, parity) - first
+		opened, err := p.open(uint64(block), slots[at:at+p.slotLength()])
+		if err != nil { //Torn or never written
+			continue
+		}
+		if s := binary.LittleEndian.Uint64(opened); s > seq && s%2 == parity%2 {
+			seq, plain = s, opened[pangolinSeqLength:]
+		}
+	}
+	p.seqs[block] = seq
+	return seq, plain, nil
+}
+
+//Decrypt a block under the current size. The returned slice must not be
+//modified.
+func (p *pangolin) block(block int64) ([]byte, error) {
+	if block == p.cached {
+		return p.cache, nil
+	}
+	var plain []byte
+	if seq, ok := p.seqs[block]; ok && seq > 0 {
+		sealed := make([]byte, p.slotLength())
+		if _, err := p.storage.ReadAt(sealed, p.slot(block, seq)); err != nil && err != io.EOF {
+			return nil, err
+		}
+		opened, err := p.open(uint64(block), sealed)
+		if err != nil {
+			return nil, err
+		}
+		plain = opened[pangolinSeqLength:]
+	} else {
+		var err error
+		if _, plain, err = p.current(block); err != nil {
+			return nil, err
+		}
+	}
+	if plain == nil {
+		return nil, errors.New("Pangolin block is missing")
+	}
+	p.cached, p.cache = block, plain
+	return plain, nil
+}
+
+//Encrypt plain, blocksize bytes, as the new content of block, into the slot
+//not in force
+func (p *pangolin) seal(block int64, plain []byte) error {
+	seq, ok := p.seqs[block]
+	if !ok {
+		var err error
+		if seq, _, err = p.current(block); err != nil {
+			return err
+		}
+	}
+	seq++
+	versioned := make([]byte, pangolinSeqLength+len(plain))
+	binary.LittleEndian.PutUint64(versioned, seq)
+	copy(versioned[pangolinSeqLength:], plain)
+	sealed, err := p.sealed(uint64(block), versioned)
+	if err != nil {
+		return err
+	}
+	p.cached = -1
+	if _, err = p.storage.WriteAt(sealed, p.slot(block, seq)); err != nil {
+		return err //The version before stays in force
+	}
+	p.seqs[block] = seq
+	return nil
+}
+
+//Seal the current size into the Size record not in force, putting it in
+//force
+func (p *pangolin) writeSize() error {
+	plain := make([]byte, 16)
+	binary.LittleEndian.PutUint64(plain, p.seq+1)
+	binary.LittleEndian.PutUint64(plain[8:], uint64(p.size))
+	sealed, err := p.sealed(pangolinSizeBlock, plain)
+	if err != nil {
+		return err
+	}
+	p.seq++
+	_, err = p.storage.WriteAt(sealed, pangolinheadLength+int64(p.seq%2)*pangolinsizeLength)
+	return err
+}
+
+//Write data at off, zero-filling any gap after the current size. Data may be
+//nil to only grow the storage to off.
+func (p *pangolin) write(data []byte, off int64) error {
+	end := off + int64(len(data))
+	if end <= p.size && len(data) == 0 {
+		return nil
+	}
+	first := off / p.blocksize
+	if off > p.size { //The old last block and the gap are rewritten too
+		first = p.size / p.blocksize
+	}
+	last := (end - 1) / p.blocksize
+
+	for block := first; block <= last; block++ {
+		plain := make([]byte, p.blocksize)
+		if length := p.length(block); length > 0 { //Bytes past the size are left zero
+			old, err := p.block(block)
+			if err != nil {
+				return err
+			}
+			copy(plain, old[:length])
+		}
+		start := block * p.blocksize
+		if start < end && start+p.blocksize > off {
+			from := off - start
+			if from < 0 {
+				copy(plain, data[-from:])
+			} else {
+				copy(plain[from:], data)
+			}
+		}
+		if err := p.seal(block, plain); err != nil {
+			return err
+		}
+	}
+	if end > p.size {
+		p.size = end
+		return p.writeSize()
+	}
+	return nil
+}
+
+//Public methods
+//=============================================================================
+func (p *pangolin) ReadAt(b []byte, off int64) (n int, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	for n < len(b) && off < p.size {
+		block := off / p.blocksize
+		plain, err := p.block(block)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(b[n:], plain[off-block*p.blocksize:p.length(block)])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+func (p *pangolin) WriteAt(b []byte, off int64) (n int, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if err = p.write(b, off); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *pangolin) Size() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.size
+}
+
+func (p *pangolin) Truncate(size int64) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if size < 0 {
+		return errors.New("Negative size")
+	}
+	if size >= p.size {
+		return p.write(nil, size)
+	}
+	p.size = size //Bytes past it in the last block are zeroed when it grows
+	if err := p.writeSize(); err != nil {
+		return err
+	}
+	return p.storage.Truncate(p.slot(p.blocks(), 1))
+}
+
+//Sync the underlying storage if possible
+func (p *pangolin) Sync() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.storage.(interface {
+		Sync() error
+	}); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (p *pangolin) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.storage.Close()
+}
+
+//Re-encrypt the whole content with key into an empty storage dst. The old
+//storage is left untouched and can be removed once the new one is in use.
+func (p *pangolin) RotateKey(dst BearStorage, key []byte) (*pangolin, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n, err := NewPangolin(dst, key, int(p.blocksize))
+	if err != nil {
+		return nil, err
+	}
+	for block := int64(0); block < p.blocks(); block++ {
+		plain, err := p.block(block)
+		if err != nil {
+			return nil, err
+		}
+		if err = n.seal(block, plain); err != nil {
+			return nil, err
+		}
+	}
+	n.size = p.size
+	return n, n.writeSize()
+}
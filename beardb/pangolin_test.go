@@ -0,0 +1,93 @@
+package beardb
+
+import (
+	"bytes"
+	"testing"
+)
+
+//The size survives reopening, and losing slots under it is found
+func TestPangolinReopenAfterTruncate(t *testing.T) {
+	key := make([]byte, 32)
+	under := NewKoala(0)
+	p, err := NewPangolin(under, key, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	if _, err = p.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{70, 64, 63, 3, 0} {
+		if err = p.Truncate(size); err != nil {
+			t.Fatal(err)
+		}
+		q, err := NewPangolin(under, key, 0)
+		if err != nil {
+			t.Fatalf("reopening after Truncate(%d): %v", size, err)
+		}
+		if q.Size() != size {
+			t.Fatalf("size after Truncate(%d) and reopening is %d", size, q.Size())
+		}
+		got := make([]byte, size)
+		if _, err = q.ReadAt(got, 0); err != nil {
+			t.Fatalf("reading after Truncate(%d) and reopening: %v", size, err)
+		}
+		if !bytes.Equal(got, data[:size]) {
+			t.Fatalf("content after Truncate(%d) and reopening is %q", size, got)
+		}
+	}
+
+	//Grown again, the bytes cut off must not come back
+	p.WriteAt(data, 0)
+	p.Truncate(5)
+	p.Truncate(20)
+	q, err := NewPangolin(under, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 20)
+	q.ReadAt(got, 0)
+	if want := append([]byte("01234"), make([]byte, 15)...); !bytes.Equal(got, want) {
+		t.Fatalf("content after growing again is %q, want %q", got, want)
+	}
+
+	//Both slots of the last block dropped
+	p.WriteAt(data, 0)
+	under.Truncate(p.slot(p.blocks()-1, 1))
+	if _, err = NewPangolin(under, key, 0); err == nil {
+		t.Fatal("dropping the last slot went unnoticed")
+	}
+}
+
+//A write torn by a crash leaves the block as it was before
+func TestPangolinTornWrite(t *testing.T) {
+	key := make([]byte, 32)
+	under := NewKoala(0)
+	p, err := NewPangolin(under, key, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte("a"), 40)
+	p.WriteAt(want, 0)
+	p.WriteAt([]byte("bbbb"), 20)                   //Block 1 again, into its other slot
+	under.WriteAt(make([]byte, 10), p.slot(1, 2)+5) //Torn
+
+	q, err := NewPangolin(under, key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 40)
+	if _, err = q.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("content after a torn write is %q, want %q", got, want)
+	}
+	if _, err = q.WriteAt([]byte("cc"), 20); err != nil {
+		t.Fatal(err)
+	}
+	q.ReadAt(got, 0)
+	if want[20], want[21] = 'c', 'c'; !bytes.Equal(got, want) {
+		t.Fatalf("content after writing again is %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,343 @@
+package beardb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Data Structures
+/*=============================================================================
+A persistent koala keeps all data in memory, like a koala, but survives a
+crash. Its directory holds a checkpoint and the logs of every mutation since:
+
+dir/checkpoint   the image at the start of log <seq in checkpoint header>
+dir/log.<seq>    mutations made after it, in order
+
+LogRecord:
+---------------------------------------------------
+|kind byte|off int64|length uint32|crc uint32|data|
+---------------------------------------------------
+Kind is logWrite for WriteAt(data, off) and logTruncate for Truncate(off).
+Crc is the checksum of the record up to crc followed by data.
+
+Every interval a new checkpoint is taken. Mutations are switched to a new
+log at the very moment the image is frozen, so the new log starts exactly
+at the image. Once the checkpoint is on disk the older logs are removed.
+The log is synced every second. On open the checkpoint is loaded and every
+log from its seq on is replayed, stopping at the first torn record. A record
+whose write fails is cut off the log at once, so no record is ever appended
+after a torn one. If it cannot be cut off, all later mutations fail until
+the next checkpoint, which leaves the log behind.
+=============================================================================*/
+const (
+	logRecordLength = 17
+	logWrite        = 0
+	logTruncate     = 1
+	logSyncInterval = time.Second
+)
+
+type persistentKoala struct {
+	mem         *koala //Not embedded, as every mutation must be logged
+	dir         string
+	log         *os.File
+	end         int64      //End of the last whole record in the log
+	failed      error      //A torn record left in the log, failing mutations
+	seq         int64      //Generation of the current log
+	closed      bool       //Set once Close has begun
+	lock        sync.Mutex //Keeps log order the same as memory order
+	checkpoints sync.Mutex //Keeps checkpoints from overtaking each other
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+//Open or create the persistent koala in dir, taking a checkpoint every
+//interval, or only on Checkpoint and Close if interval is not positive
+func OpenPersistentKoala(dir string, interval time.Duration) (*persistentKoala, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	p := &persistentKoala{mem: NewKoala(0), dir: dir,
+		stop: make(chan struct{}), done: make(chan struct{})}
+
+	image, seq, err := readCheckpoint(p.checkpointPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	p.mem.data = image
+	logs, err := p.logs()
+	if err != nil {
+		return nil, err
+	}
+	for _, gen := range logs {
+		if gen < seq {
+			continue
+		}
+		if !p.replay(gen) {
+			break
+		}
+	}
+	for _, gen := range logs {
+		if gen > seq {
+			seq = gen
+		}
+	}
+
+	//Start over from a fresh checkpoint, so torn logs are never appended to
+	p.seq = seq
+	if p.log, err = p.createLog(seq + 1); err != nil {
+		return nil, err
+	}
+	p.seq = seq + 1
+	if err = writeCheckpoint(p.checkpointPath(), p.mem.freeze(), p.seq); err != nil {
+		p.log.Close()
+		return nil, err
+	}
+	p.removeLogs(p.seq)
+
+	go p.background(interval)
+	return p, nil
+}
+
+func (p *persistentKoala) checkpointPath() string {
+	return filepath.Join(p.dir, "checkpoint")
+}
+
+func (p *persistentKoala) logPath(gen int64) string {
+	return filepath.Join(p.dir, "log."+strconv.FormatInt(gen, 10))
+}
+
+//Generations of all logs in dir, ascending
+func (p *persistentKoala) logs() ([]int64, error) {
+	paths, err := filepath.Glob(filepath.Join(p.dir, "log.*"))
+	if err != nil {
+		return nil, err
+	}
+	var logs []int64
+	for _, path := range paths {
+		gen, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(path), "log."), 10, 64)
+		if err == nil {
+			logs = append(logs, gen)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i] < logs[j] })
+	return logs, nil
+}
+
+func (p *persistentKoala) createLog(gen int64) (*os.File, error) {
+	return os.OpenFile(p.logPath(gen), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+}
+
+//Remove logs older than gen
+func (p *persistentKoala) removeLogs(gen int64) {
+	logs, _ := p.logs()
+	for _, old := range logs {
+		if old < gen {
+			os.Remove(p.logPath(old))
+		}
+	}
+}
+
+//Apply the log of gen to memory. Returns false if it ends in a torn record.
+func (p *persistentKoala) replay(gen int64) bool {
+	file, err := os.Open(p.logPath(gen))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, logRecordLength)
+	for {
+		if _, err = io.ReadFull(file, head); err != nil {
+			return err == io.EOF
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(head[9:]))
+		if _, err = io.ReadFull(file, data); err != nil {
+			return false
+		}
+		crc := crc32.Update(crc32.ChecksumIEEE(head[:13]), crc32.IEEETable, data)
+		if crc != binary.LittleEndian.Uint32(head[13:]) {
+			return false
+		}
+		off := int64(binary.LittleEndian.Uint64(head[1:]))
+		if head[0] == logTruncate {
+			p.mem.Truncate(off)
+		} else {
+			p.mem.WriteAt(data, off)
+		}
+	}
+}
+
+//Append a record to the log. Must hold the lock.
+func (p *persistentKoala) record(kind byte, data []byte, off int64) error {
+	if p.failed != nil {
+		return p.failed
+	}
+	record := make([]byte, logRecordLength+len(data))
+	record[0] = kind
+	binary.LittleEndian.PutUint64(record[1:], uint64(off))
+	binary.LittleEndian.PutUint32(record[9:], uint32(len(data)))
+	copy(record[logRecordLength:], data)
+	crc := crc32.Update(crc32.ChecksumIEEE(record[:13]), crc32.IEEETable, data)
+	binary.LittleEndian.PutUint32(record[13:], crc)
+	if _, err := p.log.WriteAt(record, p.end); err != nil {
+		if terr := p.log.Truncate(p.end); terr != nil {
+			p.failed = terr
+		}
+		return err
+	}
+	p.end += int64(len(record))
+	return nil
+}
+
+func (p *persistentKoala) background(interval time.Duration) {
+	defer close(p.done)
+	var checkpoints <-chan time.Time //Never fires if interval is not positive
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		checkpoints = ticker.C
+	}
+	syncs := time.NewTicker(logSyncInterval)
+	defer syncs.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-syncs.C:
+			p.Sync()
+		case <-checkpoints:
+			p.Checkpoint()
+		}
+	}
+}
+
+//Public methods
+//=============================================================================
+func (p *persistentKoala) ReadAt(b []byte, off int64) (n int, err error) {
+	return p.mem.ReadAt(b, off)
+}
+
+func (p *persistentKoala) Size() int64 {
+	return p.mem.Size()
+}
+
+func (p *persistentKoala) freeze() []byte {
+	return p.mem.freeze()
+}
+
+func (p *persistentKoala) WriteAt(b []byte, off int64) (n int, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return 0, ErrClosed
+	}
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if err = p.record(logWrite, b, off); err != nil {
+		return 0, err
+	}
+	return p.mem.WriteAt(b, off)
+}
+
+func (p *persistentKoala) Truncate(size int64) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	if size < 0 {
+		return errors.New("Negative size")
+	}
+	if err := p.record(logTruncate, nil, size); err != nil {
+		return err
+	}
+	return p.mem.Truncate(size)
+}
+
+//Sync the log to disk
+func (p *persistentKoala) Sync() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	return p.log.Sync()
+}
+
+//Take a checkpoint now and drop the logs it covers. Writers are only
+//blocked while switching logs. Checkpoints are taken one at a time, as an
+//older one renamed over a newer one would lose the logs the newer removed.
+func (p *persistentKoala) Checkpoint() error {
+	p.lock.Lock()
+	closed := p.closed
+	p.lock.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	return p.checkpoint()
+}
+
+func (p *persistentKoala) checkpoint() error {
+	p.checkpoints.Lock()
+	defer p.checkpoints.Unlock()
+	p.lock.Lock()
+	log, err := p.createLog(p.seq + 1)
+	if err != nil {
+		p.lock.Unlock()
+		return err
+	}
+	old := p.log
+	p.log, p.end = log, 0
+	p.seq++
+	seq := p.seq
+	image := p.mem.freeze()
+	p.lock.Unlock()
+
+	if err = old.Sync(); err != nil {
+		old.Close()
+		return err
+	}
+	old.Close()
+	if err = writeCheckpoint(p.checkpointPath(), image, seq); err != nil {
+		return err
+	}
+	p.removeLogs(seq)
+	p.lock.Lock()
+	p.failed = nil //The torn record is in a log left behind
+	p.lock.Unlock()
+	return nil
+}
+
+//Take a final checkpoint and close. Later operations fail with ErrClosed,
+//and closing again does nothing.
+func (p *persistentKoala) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.lock.Unlock()
+	close(p.stop)
+	<-p.done
+	err := p.checkpoint()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if cerr := p.log.Close(); err == nil {
+		err = cerr
+	}
+	p.mem.Close()
+	return err
+}
@@ -0,0 +1,452 @@
+package beardb
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+//Replication
+/*=============================================================================
+A primary numbers every write to the storage of its bear and keeps the
+latest ones in memory. A follower connects with the position it has
+reached, and the primary streams the writes from there on, which the
+follower applies to its own storage at the same offsets, so ids are the same
+on both sides. A follower too far behind, or coming from another primary,
+first gets a full image taken like a backup. The follower collects the image
+in a scratch storage and puts it in its storage in one go under the lock of
+its bear, so its readers go on seeing the old content until the image is
+complete.
+
+Position is the epoch of the primary, random on every start, and the number
+of the next write to apply. It can be saved by the follower and handed back
+after a restart. The epoch and the writes kept are in memory only, so a
+restarted primary has a new epoch and every follower starts over with a full
+image.
+
+Handshake from the follower:
+--------------------------
+|magic|epoch uint64|seq int64|
+--------------------------
+Frame from the primary:
+-----------------------------------------------
+|kind byte|seq int64|off int64|length uint32|data|
+-----------------------------------------------
+frameHello     off is the epoch, seq the latest write
+frameWrite     write data at off, the write numbered seq
+frameTruncate  truncate to off, the write numbered seq
+frameReset     an image of size off follows
+frameImage     write data at off, part of the image
+frameResume    the image is complete, and is at seq
+frameHeartbeat seq is the latest write
+Writes longer than replicationFrame are sent as several, and a longer frame
+is taken for a corrupted stream.
+=============================================================================*/
+const (
+	handshakeLength      = 24
+	frameLength          = 21
+	replicationMagic     = "BEARREPL"
+	replicationBatch     = 256
+	replicationFrame     = backupChunk //Longest data of a frame
+	replicationHeartbeat = time.Second
+)
+
+const (
+	frameHello = iota
+	frameWrite
+	frameTruncate
+	frameReset
+	frameImage
+	frameResume
+	frameHeartbeat
+)
+
+//Where a follower is
+type Position struct {
+	Epoch uint64
+	Seq   int64
+}
+
+type replicationRecord struct {
+	off      int64
+	data     []byte
+	truncate bool
+}
+
+//The latest writes, numbered
+type replicationLog struct {
+	records []replicationRecord
+	first   int64 //Seq of records[0]
+	retain  int
+	closed  bool
+	signal  broadcast
+	lock    sync.Mutex
+}
+
+func (l *replicationLog) append(r replicationRecord) {
+	l.lock.Lock()
+	l.records = append(l.records, r)
+	if len(l.records) > 2*l.retain { //Drop the oldest in one go
+		drop := len(l.records) - l.retain
+		l.records = append([]replicationRecord(nil), l.records[drop:]...)
+		l.first += int64(drop)
+	}
+	l.lock.Unlock()
+	l.signal.notify()
+}
+
+//Wake up and end every Serve
+func (l *replicationLog) close() {
+	l.lock.Lock()
+	l.closed = true
+	l.lock.Unlock()
+	l.signal.notify()
+}
+
+func (l *replicationLog) head() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.first + int64(len(l.records))
+}
+
+//Records from seq on, and a channel closed when there are more. Ok is false
+//if seq is no longer kept.
+func (l *replicationLog) since(seq int64) (records []replicationRecord, more <-chan struct{}, ok bool, closed bool) {
+	more = l.signal.wait() //Before looking, so no append is missed
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if seq < l.first || seq > l.first+int64(len(l.records)) {
+		return nil, more, false, l.closed
+	}
+	records = l.records[seq-l.first:]
+	if len(records) > replicationBatch {
+		records = records[:replicationBatch]
+	}
+	return records, more, true, l.closed
+}
+
+func writeFrame(w io.Writer, kind byte, seq, off int64, data []byte) error {
+	head := make([]byte, frameLength)
+	head[0] = kind
+	binary.LittleEndian.PutUint64(head[1:], uint64(seq))
+	binary.LittleEndian.PutUint64(head[9:], uint64(off))
+	binary.LittleEndian.PutUint32(head[17:], uint32(len(data)))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+//Frames the image of a resync
+type imageWriter struct {
+	w   io.Writer
+	seq int64
+	off int64
+}
+
+func (i *imageWriter) Write(p []byte) (int, error) {
+	if err := writeFrame(i.w, frameImage, i.seq, i.off, p); err != nil {
+		return 0, err
+	}
+	i.off += int64(len(p))
+	return len(p), nil
+}
+
+//The primary side
+//=============================================================================
+type primary struct {
+	lock    *rwMutex //Of the bear
+	tracker *tracker
+	epoch   uint64
+	log     *replicationLog
+}
+
+func newPrimary(lock *rwMutex, t *tracker, retain int) (*primary, error) {
+	if retain <= 0 {
+		return nil, errors.New("Invalid retain")
+	}
+	epoch := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, epoch); err != nil {
+		return nil, err
+	}
+	p := &primary{lock: lock, tracker: t, log: &replicationLog{retain: retain},
+		epoch: binary.LittleEndian.Uint64(epoch) | 1} //Epoch 0 is never valid
+
+	lock.Lock()
+	defer lock.Unlock()
+	if t.closed {
+		return nil, ErrClosed
+	}
+	if t.replica != nil {
+		return nil, errors.New("Already a primary")
+	}
+	t.replica = p.log
+	return p, nil
+}
+
+//Send a full image, returning the seq it is at
+func (p *primary) resync(w io.Writer) (int64, error) {
+	seq := p.log.head() //Writes after are replayed on top, which is harmless
+	b, err := startBackup(p.lock, p.tracker, false)
+	if err != nil {
+		return seq, err
+	}
+	err = writeFrame(w, frameReset, seq, b.tail, nil)
+	if err == nil {
+		err = copySpans(p.lock, p.tracker, b, spans{{0, b.tail}}, &imageWriter{w: w, seq: seq}, nil)
+	}
+	endBackup(p.lock, p.tracker, b, err)
+	if err == nil {
+		err = writeFrame(w, frameResume, seq, 0, nil)
+	}
+	return seq, err
+}
+
+//Serve one follower over conn until either side fails or the primary is
+//closed. Closing conn is left to the caller.
+func (p *primary) Serve(conn io.ReadWriter) error {
+	hs := make([]byte, handshakeLength)
+	if _, err := io.ReadFull(conn, hs); err != nil {
+		return err
+	}
+	if string(hs[:8]) != replicationMagic {
+		return errors.New("Not a follower")
+	}
+	epoch := binary.LittleEndian.Uint64(hs[8:])
+	seq := int64(binary.LittleEndian.Uint64(hs[16:]))
+
+	w := bufio.NewWriter(conn)
+	if err := writeFrame(w, frameHello, p.log.head(), int64(p.epoch), nil); err != nil {
+		return err
+	}
+	if _, _, ok, _ := p.log.since(seq); epoch != p.epoch || !ok {
+		var err error
+		if seq, err = p.resync(w); err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		records, more, ok, closed := p.log.since(seq)
+		if closed {
+			return w.Flush()
+		}
+		if !ok { //Fell too far behind while streaming
+			var err error
+			if seq, err = p.resync(w); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, r := range records {
+			kind := byte(frameWrite)
+			if r.truncate {
+				kind = frameTruncate
+			}
+			if err := writeFrame(w, kind, seq, r.off, r.data); err != nil {
+				return err
+			}
+			seq++
+		}
+		select {
+		case <-heartbeat.C:
+			if err := writeFrame(w, frameHeartbeat, p.log.head(), 0, nil); err != nil {
+				return err
+			}
+		default:
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			continue
+		}
+		select {
+		case <-more:
+		case <-heartbeat.C:
+			if err := writeFrame(w, frameHeartbeat, p.log.head(), 0, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//Stop keeping writes, and end all Serve calls
+func (p *primary) Close() error {
+	p.lock.Lock()
+	if p.tracker.replica == p.log {
+		p.tracker.replica = nil
+	}
+	p.lock.Unlock()
+	p.log.close()
+	return nil
+}
+
+//The follower side
+//=============================================================================
+type follower struct {
+	lock    *rwMutex //Of the bear
+	tracker *tracker
+	scratch BearStorage //Holds an image while it is received
+	pos     Position
+	head    int64 //Latest write known at the primary
+	state   sync.Mutex
+}
+
+func newFollower(lock *rwMutex, t *tracker, from Position, scratch BearStorage) *follower {
+	if scratch == nil {
+		scratch = NewKoala(0)
+	}
+	return &follower{lock: lock, tracker: t, scratch: scratch, pos: from}
+}
+
+//Replace the content of the bear with the size bytes of image under the lock
+//of the bear, so readers see either the old content or the new
+func (f *follower) swapIn(image BearStorage, size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.tracker.closed {
+		return ErrClosed
+	}
+	buff := make([]byte, backupChunk)
+	for off := int64(0); off < size; off += backupChunk {
+		chunk := buff
+		if size-off < backupChunk {
+			chunk = buff[:size-off]
+		}
+		if _, err := image.ReadAt(chunk, off); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := f.tracker.WriteAt(chunk, off); err != nil {
+			return err
+		}
+	}
+	return f.tracker.Truncate(size)
+}
+
+//Apply one write under the lock of the bear
+func (f *follower) apply(kind byte, off int64, data []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.tracker.closed {
+		return ErrClosed
+	}
+	if kind == frameTruncate {
+		return f.tracker.Truncate(off)
+	}
+	_, err := f.tracker.WriteAt(data, off)
+	return err
+}
+
+func (f *follower) setPosition(pos Position) {
+	f.state.Lock()
+	defer f.state.Unlock()
+	f.pos = pos
+	if f.head < pos.Seq {
+		f.head = pos.Seq
+	}
+}
+
+//Follow the primary over conn until either side fails or the primary is
+//closed. Run again with a new conn to resume.
+func (f *follower) Run(conn io.ReadWriter) error {
+	pos := f.Position()
+	hs := make([]byte, handshakeLength)
+	copy(hs, replicationMagic)
+	binary.LittleEndian.PutUint64(hs[8:], pos.Epoch)
+	binary.LittleEndian.PutUint64(hs[16:], uint64(pos.Seq))
+	if _, err := conn.Write(hs); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	head := make([]byte, frameLength)
+	var epoch uint64
+	image := false //Whether an image is being received
+	var imageSize int64
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		kind := head[0]
+		seq := int64(binary.LittleEndian.Uint64(head[1:]))
+		off := int64(binary.LittleEndian.Uint64(head[9:]))
+		length := binary.LittleEndian.Uint32(head[17:])
+		if length > replicationFrame {
+			return errors.New("Replication frame is too long")
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		switch kind {
+		case frameHello:
+			epoch = uint64(off)
+			f.state.Lock()
+			f.head = seq
+			f.state.Unlock()
+		case frameReset: //Until resumed, the position is worthless
+			f.setPosition(Position{})
+			if err := f.scratch.Truncate(0); err != nil {
+				return err
+			}
+			image, imageSize = true, off
+		case frameImage:
+			if !image {
+				return errors.New("Image frame outside of an image")
+			}
+			if _, err := f.scratch.WriteAt(data, off); err != nil {
+				return err
+			}
+		case frameResume:
+			if !image {
+				return errors.New("Resume frame outside of an image")
+			}
+			if err := f.swapIn(f.scratch, imageSize); err != nil {
+				return err
+			}
+			image = false
+			f.setPosition(Position{epoch, seq})
+			if err := f.scratch.Truncate(0); err != nil { //Free the space
+				return err
+			}
+		case frameWrite, frameTruncate:
+			if err := f.apply(kind, off, data); err != nil {
+				return err
+			}
+			f.setPosition(Position{epoch, seq + 1})
+		case frameHeartbeat:
+			f.state.Lock()
+			f.head = seq
+			f.state.Unlock()
+		default:
+			return errors.New("Unknown replication frame")
+		}
+	}
+}
+
+//The position reached. Save it to resume after a restart.
+func (f *follower) Position() Position {
+	f.state.Lock()
+	defer f.state.Unlock()
+	return f.pos
+}
+
+//Number of writes at the primary not applied yet, as of the last word from
+//the primary
+func (f *follower) Lag() int64 {
+	f.state.Lock()
+	defer f.state.Unlock()
+	return f.head - f.pos.Seq
+}
@@ -0,0 +1,197 @@
+package beardb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+)
+
+//Snapshots
+/*=============================================================================
+While a snapshot is open, every modify and delete first copies the entry it
+changes to a new entry at the end, and remembers the copy as a version of the
+entry, numbered by the change that replaced it. A snapshot taken at change
+seq reads an entry from its first version replaced after seq, or from the
+entry itself if it has not been replaced since.
+
+When a snapshot is closed, the copies no open snapshot can read any more are
+marked deleted. Their space is not reused.
+=============================================================================*/
+var errSnapshotClosed = errors.New("Snapshot is closed")
+
+//A copy of an entry, made before change seq replaced it
+type version struct {
+	seq int64
+	loc int64
+}
+
+//A read view of a brownBearDB
+type brownBearSnapshot struct {
+	seq    int64 //Last change seen
+	size   int64 //Later entries are not seen
+	closed bool
+	db     *brownBearDB
+}
+
+//Take a snapshot of the database as it is now. Read it with the readers it
+//makes, and close it once done, as copies are kept for it until then.
+func (db *brownBearDB) Snapshot() (*brownBearSnapshot, error) {
+	if err := db.lock(context.Background()); err != nil {
+		return nil, err
+	}
+	defer db.rwlock.Unlock()
+	s := &brownBearSnapshot{seq: db.seq, size: db.size(), db: db}
+	if db.snapshots == nil {
+		db.snapshots = make(map[*brownBearSnapshot]bool)
+		db.versions = make(map[int64][]version)
+	}
+	db.snapshots[s] = true
+	return s, nil
+}
+
+//Copy the entry at id in s if a snapshot may need it. Returns where the copy
+//is, or -1 if none was made. Must hold the write lock.
+func (db *brownBearDB) preserve(s BearStorage, id int64) (int64, error) {
+	if len(db.snapshots) == 0 {
+		return -1, nil
+	}
+	if db.versioned { //Versions are never overwritten, copy the pointer
+		loc, err := latestVersion(s, id)
+		if err != nil {
+			return -1, err
+		}
+		buff := make([]byte, datainfoLength+minEntryLength)
+		info := newDataInfo(minEntryLength)
+		info.SetLongJump(true)
+		binary.LittleEndian.PutUint32(buff, uint32(*info))
+		binary.LittleEndian.PutUint64(buff[datainfoLength:], uint64(loc))
+		at := s.Size()
+		_, err = s.WriteAt(buff, at)
+		return at, err
+	}
+	r := &SafeReader{s, id}
+	info := new(datainfo)
+	if err := info.ReadFrom(r); err != nil {
+		return -1, err
+	}
+	if info.IsDeleted() {
+		return -1, ErrDeleted
+	}
+	if info.IsLongJump() {
+		newid := new(Int64)
+		if err := newid.Deserialize(r); err != nil {
+			return -1, err
+		}
+		r.Offset = newid.Get()
+		if err := info.ReadFrom(r); err != nil {
+			return -1, err
+		}
+	}
+	data := make([]byte, info.GetLength())
+	if _, err := r.ReadAt(data, r.Offset); err != nil {
+		return -1, err
+	}
+	loc, _, err := appendEntry(s, data)
+	return loc, err
+}
+
+//Remember the copy at loc as the latest version of id. Must hold the write
+//lock.
+func (db *brownBearDB) keep(id, loc int64) {
+	if loc < 0 {
+		return
+	}
+	db.seq++
+	db.versions[id] = append(db.versions[id], version{db.seq, loc})
+}
+
+//Mark deleted the copies no open snapshot needs. Must hold the write lock.
+func (db *brownBearDB) collect() error {
+	var err error
+	for id, vs := range db.versions {
+		prev := int64(0)
+		keep := vs[:0]
+		for _, v := range vs {
+			needed := false
+			for s := range db.snapshots {
+				if s.seq >= prev && s.seq < v.seq {
+					needed = true
+					break
+				}
+			}
+			prev = v.seq
+			if needed {
+				keep = append(keep, v)
+			} else if _, derr := deleteEntry(&db.tracker, v.loc); derr != nil && err == nil {
+				err = derr
+			}
+		}
+		if len(keep) == 0 {
+			delete(db.versions, id)
+		} else {
+			db.versions[id] = keep
+		}
+	}
+	return err
+}
+
+//Where the entry at id is for the snapshot. Must hold the read lock.
+func (s *brownBearSnapshot) locate(id int64) (int64, error) {
+	if s.closed {
+		return -1, errSnapshotClosed
+	}
+	if id >= s.size {
+		return -1, errors.New("Item is newer than the snapshot")
+	}
+	for _, v := range s.db.versions[id] {
+		if v.seq > s.seq {
+			return v.loc, nil
+		}
+	}
+	return id, nil
+}
+
+//Move r to the data of the entry at id, as seen by s, or the latest if s is
+//nil. Must hold the read lock.
+func (db *brownBearDB) seek(s *brownBearSnapshot, r *SafeReader, id int64) error {
+	if s != nil {
+		var err error
+		if id, err = s.locate(id); err != nil {
+			return err
+		}
+	}
+	if db.versioned {
+		return seekEntry(r, id, versionHeaderLength)
+	}
+	return seekEntry(r, id, 0)
+}
+
+//New Gob Reader reading the snapshot
+func (s *brownBearSnapshot) NewGobReader() *brownBearGobReader {
+	b := s.db.NewGobReader()
+	b.snap = s
+	return b
+}
+
+//New Serializer Reader reading the snapshot
+func (s *brownBearSnapshot) NewSerializerReader() *brownBearSerializerReader {
+	b := s.db.NewSerializerReader()
+	b.snap = s
+	return b
+}
+
+//Release the snapshot, letting the copies kept for it go
+func (s *brownBearSnapshot) Close() error {
+	db := s.db
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	delete(db.snapshots, s)
+	if db.tracker.closed {
+		return nil
+	}
+	return db.collect()
+}
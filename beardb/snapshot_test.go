@@ -0,0 +1,106 @@
+package beardb
+
+import (
+	"fmt"
+	"testing"
+)
+
+//Item at id read by r, or the error
+func readString(r *brownBearSerializerReader, id int64) string {
+	s := new(String)
+	if err := r.GetItem(id, s); err != nil {
+		return err.Error()
+	}
+	return s.Get()
+}
+
+//Check what r reads at ids
+func expectStrings(t *testing.T, what string, r *brownBearSerializerReader, ids []int64, want []string) {
+	t.Helper()
+	for i, id := range ids {
+		if got := readString(r, id); got != want[i] {
+			t.Fatalf("%s: item %d is %q, want %q", what, i, got, want[i])
+		}
+	}
+}
+
+//Snapshots see the items as they were across Modify, Delete and long jumps,
+//and the copies kept for them go once they are closed
+func TestSnapshotIsolation(t *testing.T) {
+	db := NewBrownBearDB(NewKoala(0))
+	w := db.NewSerializerWriter()
+	ids := make([]int64, 4)
+	var err error
+	for i := range ids {
+		if ids[i], err = w.AddItem(NewString(fmt.Sprint("item ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jumped := "item 0 grown too long to stay where it was"
+	if err = w.Modify(ids[0], NewString(jumped)); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Modify(ids[1], NewString("ITEM 1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	added, err := w.AddItem(NewString("added"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = append(ids, added)
+	second, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jumpedAgain := "item 0 grown again, jumping from where it jumped to"
+	if err = w.Modify(ids[0], NewString(jumpedAgain)); err != nil {
+		t.Fatal(err)
+	}
+
+	older := []string{"item 0", "item 1", "item 2", "item 3", "Item is newer than the snapshot"}
+	newer := []string{jumped, "ITEM 1", ErrDeleted.Error(), "item 3", "added"}
+	latest := []string{jumpedAgain, "ITEM 1", ErrDeleted.Error(), "item 3", "added"}
+	expectStrings(t, "first snapshot", first.NewSerializerReader(), ids, older)
+	expectStrings(t, "second snapshot", second.NewSerializerReader(), ids, newer)
+	expectStrings(t, "latest", db.NewSerializerReader(), ids, latest)
+
+	var copies []int64
+	for _, vs := range db.versions {
+		for _, v := range vs {
+			copies = append(copies, v.loc)
+		}
+	}
+	if len(copies) != 4 {
+		t.Fatalf("%d copies kept for the snapshots, want 4", len(copies))
+	}
+	if err = first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectStrings(t, "second snapshot after closing the first", second.NewSerializerReader(), ids, newer)
+	if got := readString(first.NewSerializerReader(), ids[0]); got != errSnapshotClosed.Error() {
+		t.Fatalf("closed snapshot read %q", got)
+	}
+	if err = second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.versions) != 0 {
+		t.Fatalf("copies of %d items kept with no snapshot open", len(db.versions))
+	}
+	for _, loc := range copies {
+		info := new(datainfo)
+		if err = info.ReadFrom(&SafeReader{db.storage, loc}); err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDeleted() {
+			t.Fatalf("copy at %d is not marked deleted", loc)
+		}
+	}
+	expectStrings(t, "latest after closing the snapshots", db.NewSerializerReader(), ids, latest)
+}
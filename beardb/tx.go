@@ -0,0 +1,415 @@
+package beardb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+//Transactions
+/*=============================================================================
+A transaction only buffers its operations. On commit they are run, under the
+write lock, against a shadow of the storage which keeps the writes they
+would make aside, so a failing operation leaves nothing behind and readers
+see either none or all of them. The writes are then made for real.
+
+Transactions need a write-ahead log, set by SetWAL. The writes are first
+written to it and synced, and it is cleared once they are in the storage.
+Once logged the transaction is committed. If a crash cuts the writes short,
+they are made again by SetWAL on the next open. If a failure does, every
+later operation makes them first and fails while it cannot, so the
+transaction is never seen half made nor dropped from the WAL by the next.
+
+WAL:
+----------------------------------------
+|magic|count uint32|crc uint32|Write...|
+----------------------------------------
+Write:
+--------------------------------
+|off int64|length uint32|data|
+--------------------------------
+Crc is the checksum of all writes. A WAL that does not check out was never
+committed, and is dropped.
+=============================================================================*/
+const (
+	walinfoLength  = 16
+	walWriteLength = 12
+	walMagic       = "BEARWLOG"
+)
+
+var (
+	ErrNoWAL  = errors.New("Transactions need a WAL")
+	errTxDone = errors.New("Transaction is already finished")
+)
+
+//A write kept aside
+type shadowWrite struct {
+	off  int64
+	data []byte
+}
+
+//A storage reading through to base, keeping every write aside
+type shadow struct {
+	base   BearStorage
+	size   int64
+	writes []shadowWrite
+}
+
+func (s *shadow) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > s.size {
+		p = p[:s.size-off]
+		err = io.EOF
+	}
+	n, rerr := s.base.ReadAt(p, off)
+	if rerr != nil && rerr != io.EOF {
+		return n, rerr
+	}
+	for i := n; i < len(p); i++ { //Past the end of base
+		p[i] = 0
+	}
+	for _, w := range s.writes {
+		start, end := w.off, w.off+int64(len(w.data))
+		if start < off {
+			start = off
+		}
+		if end > off+int64(len(p)) {
+			end = off + int64(len(p))
+		}
+		if start < end {
+			copy(p[start-off:end-off], w.data[start-w.off:])
+		}
+	}
+	return len(p), err
+}
+
+func (s *shadow) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.writes = append(s.writes, shadowWrite{off, append([]byte(nil), p...)})
+	if end := off + int64(len(p)); end > s.size {
+		s.size = end
+	}
+	return len(p), nil
+}
+
+func (s *shadow) Truncate(size int64) error {
+	return errors.New("Cannot truncate in a transaction")
+}
+
+func (s *shadow) Size() int64 {
+	return s.size
+}
+
+func (s *shadow) Close() error {
+	return nil
+}
+
+//Write-ahead log
+//=============================================================================
+type wal struct {
+	storage BearStorage
+	logged  []shadowWrite //Not all made yet, nil if none
+}
+
+//Durably log writes, replacing what was logged before
+func (w *wal) log(writes []shadowWrite) error {
+	length := walinfoLength
+	for _, sw := range writes {
+		length += walWriteLength + len(sw.data)
+	}
+	buff := make([]byte, length)
+	copy(buff, walMagic)
+	binary.LittleEndian.PutUint32(buff[8:], uint32(len(writes)))
+	p := buff[walinfoLength:]
+	for _, sw := range writes {
+		binary.LittleEndian.PutUint64(p, uint64(sw.off))
+		binary.LittleEndian.PutUint32(p[8:], uint32(len(sw.data)))
+		copy(p[walWriteLength:], sw.data)
+		p = p[walWriteLength+len(sw.data):]
+	}
+	binary.LittleEndian.PutUint32(buff[12:], crc32.ChecksumIEEE(buff[walinfoLength:]))
+
+	if err := w.storage.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.storage.WriteAt(buff, 0); err != nil {
+		return err
+	}
+	return syncStorage(w.storage)
+}
+
+//The writes logged and not cleared, nil if none
+func (w *wal) pending() ([]shadowWrite, error) {
+	size := w.storage.Size()
+	if size < walinfoLength {
+		return nil, nil
+	}
+	buff := make([]byte, size)
+	if _, err := w.storage.ReadAt(buff, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(buff[:8]) != walMagic ||
+		crc32.ChecksumIEEE(buff[walinfoLength:]) != binary.LittleEndian.Uint32(buff[12:]) {
+		return nil, nil //Torn, so never committed
+	}
+	writes := make([]shadowWrite, binary.LittleEndian.Uint32(buff[8:]))
+	p := buff[walinfoLength:]
+	for i := range writes {
+		if len(p) < walWriteLength {
+			return nil, errors.New("WAL is corrupted")
+		}
+		length := int(binary.LittleEndian.Uint32(p[8:]))
+		if len(p) < walWriteLength+length {
+			return nil, errors.New("WAL is corrupted")
+		}
+		writes[i] = shadowWrite{int64(binary.LittleEndian.Uint64(p)), p[walWriteLength : walWriteLength+length]}
+		p = p[walWriteLength+length:]
+	}
+	return writes, nil
+}
+
+func (w *wal) clear() error {
+	if err := w.storage.Truncate(0); err != nil {
+		return err
+	}
+	return syncStorage(w.storage)
+}
+
+//Make the writes pending in the WAL, if any, and clear it. Until this
+//succeeds the WAL keeps them, so they are never lost to a later log. Must
+//hold the write lock.
+func (db *brownBearDB) redo() error {
+	for _, w := range db.wal.logged {
+		if _, err := db.tracker.WriteAt(w.data, w.off); err != nil {
+			return err
+		}
+	}
+	if err := syncStorage(db.storage); err != nil {
+		return err
+	}
+	if err := db.wal.clear(); err != nil {
+		return err
+	}
+	db.wal.logged = nil
+	return nil
+}
+
+//Make writes to the storage of the bear, through the WAL if any. Must hold
+//the write lock. Once logged is true the writes are committed: if making
+//them fails they stay pending, and are made again by the next operation or
+//by SetWAL on the next open.
+func (db *brownBearDB) apply(writes []shadowWrite) (logged bool, err error) {
+	if db.wal == nil {
+		for _, w := range writes {
+			if _, err := db.tracker.WriteAt(w.data, w.off); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	if db.wal.logged != nil {
+		if err := db.redo(); err != nil {
+			return false, err
+		}
+	}
+	if err := db.wal.log(writes); err != nil {
+		return false, err
+	}
+	db.wal.logged = writes
+	if err := db.redo(); err != nil {
+		return true, db.redo() //Once more, or left for later
+	}
+	return true, nil
+}
+
+//Log the writes of transactions to s before making them, so a crash never
+//leaves a transaction half done. A transaction cut short by a crash is
+//completed here, so set the WAL right after opening.
+func (db *brownBearDB) SetWAL(s BearStorage) error {
+	if err := db.lock(context.Background()); err != nil {
+		return err
+	}
+	defer db.rwlock.Unlock()
+	w := &wal{storage: s}
+	writes, err := w.pending()
+	if err != nil {
+		return err
+	}
+	old := db.wal
+	db.wal = w
+	w.logged = writes
+	if err = db.redo(); err != nil {
+		db.wal = old
+		return err
+	}
+	return nil
+}
+
+//Transaction
+//=============================================================================
+type txOp struct {
+	kind EventKind
+	id   int64
+	data []byte
+}
+
+type brownBearTx struct {
+	ops  []txOp
+	done bool
+	lock sync.Mutex
+	db   *brownBearDB
+}
+
+//Begin a transaction. Add to it with the Tx methods of the writers and
+//Delete, then Commit or Rollback. Fails with ErrNoWAL if no WAL is set.
+func (db *brownBearDB) Begin() (*brownBearTx, error) {
+	if err := db.rlock(context.Background()); err != nil {
+		return nil, err
+	}
+	defer db.rwlock.RUnlock()
+	if db.wal == nil {
+		return nil, ErrNoWAL
+	}
+	return &brownBearTx{db: db}, nil
+}
+
+func (tx *brownBearTx) push(op txOp) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return errTxDone
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+func (tx *brownBearTx) add(data []byte) error {
+	if len(data) > maxEntryLength {
+		return errors.New("Item is too large")
+	}
+	return tx.push(txOp{EventAppend, -1, data})
+}
+
+func (tx *brownBearTx) modify(id int64, data []byte) error {
+	return tx.push(txOp{EventModify, id, data})
+}
+
+//Delete the entry at id on commit
+func (tx *brownBearTx) Delete(id int64) error {
+	return tx.push(txOp{EventDelete, id, nil})
+}
+
+//Take the operations, finishing the transaction
+func (tx *brownBearTx) finish() ([]txOp, error) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return nil, errTxDone
+	}
+	tx.done = true
+	ops := tx.ops
+	tx.ops = nil
+	return ops, nil
+}
+
+//Make all operations, in order, or none. The ids of the appended entries are
+//returned in order.
+func (tx *brownBearTx) Commit() ([]int64, error) {
+	return tx.CommitContext(context.Background())
+}
+
+//Same as Commit, giving up once ctx is done
+func (tx *brownBearTx) CommitContext(ctx context.Context) ([]int64, error) {
+	ops, err := tx.finish()
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.db.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer tx.db.rwlock.Unlock()
+	return tx.db.commit(ops)
+}
+
+//Run ops against a shadow of the storage, update the indexes, log the
+//changes in the feed and make the writes, undoing the index updates if they
+//fail. Ids of the entries added are returned. Must hold the write lock.
+func (db *brownBearDB) commit(ops []txOp) ([]int64, error) {
+	sh := &shadow{base: &db.tracker, size: db.size()}
+	var ids []int64
+	var updates []indexUpdate
+	records := make([]feedRecord, len(ops))
+	locs := make([]int64, len(ops))
+	for i, op := range ops {
+		var err error
+		var old []byte
+		if op.kind != EventAppend {
+			if old, err = db.indexedData(sh, op.id); err != nil {
+				return nil, err
+			}
+			if locs[i], err = db.preserve(sh, op.id); err != nil {
+				return nil, err
+			}
+		}
+		switch op.kind {
+		case EventAppend:
+			var id int64
+			id, records[i], err = db.appendTo(sh, op.data)
+			ids = append(ids, id)
+		case EventModify:
+			records[i], err = db.modifyIn(sh, op.id, op.data)
+		case EventDelete:
+			records[i], err = deleteEntry(sh, op.id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		u, err := db.indexUpdates(records[i].id, old, op.data)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, u...)
+	}
+	if err := updateIndexes(updates); err != nil {
+		return nil, err
+	}
+	if err := db.logChanges(records...); err != nil {
+		undoIndexes(updates)
+		db.publish(0)
+		return nil, err
+	}
+	logged, err := db.apply(sh.writes)
+	if err != nil && !logged {
+		undoIndexes(updates)
+		db.publish(0)
+		return nil, err
+	}
+	for i, op := range ops {
+		if op.kind != EventAppend {
+			db.keep(op.id, locs[i])
+		}
+	}
+	if perr := db.publish(len(records)); err == nil {
+		err = perr
+	}
+	return ids, err
+}
+
+//Drop all operations
+func (tx *brownBearTx) Rollback() error {
+	_, err := tx.finish()
+	return err
+}
@@ -0,0 +1,229 @@
+package beardb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+//Versioned mode
+/*=============================================================================
+In a versioned brownBearDB every entry is a LongJump to its latest version,
+and every version points to the one it replaced:
+
+VersionRecord:
+----------------------------------------------------------------
+|datainfo|version uint32|timestamp int64|prev int64|   data   |
+----------------------------------------------------------------
+Version counts from 1, timestamp is in nanoseconds since the Unix epoch and
+prev is -1 for the first version. Modify appends a new version and points
+the entry to it, so nothing is ever overwritten. With retain set, only that
+many versions before the latest are kept, older ones are marked deleted.
+A database must always be opened in the same mode.
+=============================================================================*/
+const versionHeaderLength = 20
+
+//A version of an entry
+type VersionInfo struct {
+	Version   uint32
+	Timestamp time.Time
+}
+
+type versionHeader struct {
+	version   uint32
+	timestamp int64
+	prev      int64
+}
+
+//Constructor of a versioned database keeping retain versions before the
+//latest of every entry, or all of them if retain is 0
+func NewVersionedBrownBearDB(s BearStorage, retain int) *brownBearDB {
+	db := NewBrownBearDB(s)
+	db.versioned, db.retain = true, retain
+	return db
+}
+
+func readVersionHeader(s BearStorage, loc int64) (*versionHeader, error) {
+	buff := make([]byte, versionHeaderLength)
+	if _, err := s.ReadAt(buff, loc+datainfoLength); err != nil {
+		return nil, err
+	}
+	return &versionHeader{binary.LittleEndian.Uint32(buff),
+		int64(binary.LittleEndian.Uint64(buff[4:])), int64(binary.LittleEndian.Uint64(buff[12:]))}, nil
+}
+
+//Location of the latest version of the entry at id
+func latestVersion(s BearStorage, id int64) (int64, error) {
+	r := &SafeReader{s, id}
+	info := new(datainfo)
+	if err := info.ReadFrom(r); err != nil {
+		return -1, err
+	}
+	if info.IsDeleted() {
+		return -1, ErrDeleted
+	}
+	if !info.IsLongJump() {
+		return -1, errors.New("Not a versioned entry")
+	}
+	loc := new(Int64)
+	if err := loc.Deserialize(r); err != nil {
+		return -1, err
+	}
+	return loc.Get(), nil
+}
+
+//Append a version record followed by the entry pointing to it
+func appendVersioned(s BearStorage, data []byte) (int64, feedRecord, error) {
+	if len(data) > maxEntryLength-versionHeaderLength {
+		return -1, feedRecord{}, errors.New("Item is too large")
+	}
+	loc := s.Size()
+	length := datainfoLength + versionHeaderLength + len(data)
+	buff := make([]byte, length+datainfoLength+minEntryLength)
+	binary.LittleEndian.PutUint32(buff, uint32(*newDataInfo(versionHeaderLength + len(data))))
+	binary.LittleEndian.PutUint32(buff[4:], 1)
+	binary.LittleEndian.PutUint64(buff[8:], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint64(buff[16:], ^uint64(0)) //No prev
+	copy(buff[datainfoLength+versionHeaderLength:], data)
+
+	head := newDataInfo(minEntryLength)
+	head.SetLongJump(true)
+	binary.LittleEndian.PutUint32(buff[length:], uint32(*head))
+	binary.LittleEndian.PutUint64(buff[length+datainfoLength:], uint64(loc))
+	if _, err := s.WriteAt(buff, loc); err != nil {
+		return -1, feedRecord{}, err
+	}
+	id := int64(length) + loc
+	return id, feedRecord{id, loc, EventAppend}, nil
+}
+
+//Append a new version of the entry at id holding data, and drop versions
+//past retain
+func modifyVersioned(s BearStorage, id int64, data []byte, retain int) (feedRecord, error) {
+	if len(data) > maxEntryLength-versionHeaderLength {
+		return feedRecord{}, errors.New("Item is too large")
+	}
+	prev, err := latestVersion(s, id)
+	if err != nil {
+		return feedRecord{}, err
+	}
+	h, err := readVersionHeader(s, prev)
+	if err != nil {
+		return feedRecord{}, err
+	}
+	loc := s.Size()
+	r := feedRecord{id, loc, EventModify}
+	buff := make([]byte, datainfoLength+versionHeaderLength+len(data))
+	binary.LittleEndian.PutUint32(buff, uint32(*newDataInfo(versionHeaderLength + len(data))))
+	binary.LittleEndian.PutUint32(buff[4:], h.version+1)
+	binary.LittleEndian.PutUint64(buff[8:], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint64(buff[16:], uint64(prev))
+	copy(buff[datainfoLength+versionHeaderLength:], data)
+	if _, err = s.WriteAt(buff, loc); err != nil {
+		return r, err
+	}
+	if err = NewInt64(loc).Serialize(&SafeWriter{s, id + datainfoLength}); err != nil {
+		return r, err
+	}
+	if retain > 0 {
+		return r, dropVersions(s, loc, retain)
+	}
+	return r, nil
+}
+
+//Keep retain versions before the one at loc, marking older ones deleted
+func dropVersions(s BearStorage, loc int64, retain int) error {
+	for i := 0; i < retain; i++ {
+		h, err := readVersionHeader(s, loc)
+		if err != nil || h.prev < 0 {
+			return err
+		}
+		loc = h.prev
+	}
+	h, err := readVersionHeader(s, loc)
+	if err != nil || h.prev < 0 {
+		return err
+	}
+	old := h.prev
+	if err = NewInt64(-1).Serialize(&SafeWriter{s, loc + datainfoLength + 12}); err != nil {
+		return err
+	}
+	for old >= 0 {
+		if h, err = readVersionHeader(s, old); err != nil {
+			return err
+		}
+		rw := &SafeReadWriter{s, old}
+		info := new(datainfo)
+		if err = info.ReadFrom(rw); err != nil {
+			return err
+		}
+		if info.IsDeleted() { //Dropped before
+			return nil
+		}
+		info.SetDeleted(true)
+		rw.Offset = old
+		if err = info.WriteTo(rw); err != nil {
+			return err
+		}
+		old = h.prev
+	}
+	return nil
+}
+
+//Location of version v of the entry at id. Must hold the read lock.
+func (db *brownBearDB) findVersion(id int64, v uint32) (int64, error) {
+	if !db.versioned {
+		return -1, errors.New("Database is not versioned")
+	}
+	loc, err := latestVersion(db.storage, id)
+	for err == nil {
+		var h *versionHeader
+		if h, err = readVersionHeader(db.storage, loc); err != nil {
+			break
+		}
+		if h.version == v {
+			return loc, nil
+		}
+		if h.version < v || h.prev < 0 {
+			break
+		}
+		loc = h.prev
+	}
+	if err == nil {
+		err = errors.New("No such version")
+	}
+	return -1, err
+}
+
+//The versions of the entry at id that are kept, latest first
+func (db *brownBearDB) History(id int64) ([]VersionInfo, error) {
+	return db.HistoryContext(context.Background(), id)
+}
+
+//Same as History, giving up once ctx is done
+func (db *brownBearDB) HistoryContext(ctx context.Context, id int64) ([]VersionInfo, error) {
+	if err := db.rlock(ctx); err != nil {
+		return nil, err
+	}
+	defer db.rwlock.RUnlock()
+	if !db.versioned {
+		return nil, errors.New("Database is not versioned")
+	}
+	s := readerContext(ctx, db.storage)
+	loc, err := latestVersion(db.storage, id)
+	if err != nil {
+		return nil, err
+	}
+	var history []VersionInfo
+	for loc >= 0 {
+		buff := make([]byte, versionHeaderLength)
+		if _, err = s.ReadAt(buff, loc+datainfoLength); err != nil {
+			return nil, err
+		}
+		history = append(history, VersionInfo{binary.LittleEndian.Uint32(buff),
+			time.Unix(0, int64(binary.LittleEndian.Uint64(buff[4:])))})
+		loc = int64(binary.LittleEndian.Uint64(buff[12:]))
+	}
+	return history, nil
+}
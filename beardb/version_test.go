@@ -0,0 +1,70 @@
+package beardb
+
+import (
+	"fmt"
+	"testing"
+)
+
+//History and GetItemAt give the versions kept, which retain limits, also
+//after reopening
+func TestVersionRetention(t *testing.T) {
+	for _, retain := range []int{0, 2} {
+		s := NewKoala(0)
+		db := NewVersionedBrownBearDB(s, retain)
+		w := db.NewSerializerWriter()
+		id, err := w.AddItem(NewString("version 1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := w.AddItem(NewString("other"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		const versions = 6
+		for v := 2; v <= versions; v++ {
+			if err = w.Modify(id, NewString(fmt.Sprint("version ", v))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		kept := versions
+		if retain > 0 {
+			kept = retain + 1
+		}
+
+		for _, db := range []*brownBearDB{db, NewVersionedBrownBearDB(s, retain)} {
+			history, err := db.History(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != kept {
+				t.Fatalf("retain %d: %d versions kept, want %d", retain, len(history), kept)
+			}
+			for i, h := range history {
+				if h.Version != uint32(versions-i) {
+					t.Fatalf("retain %d: version %d of the history is %d", retain, i, h.Version)
+				}
+				if i > 0 && h.Timestamp.After(history[i-1].Timestamp) {
+					t.Fatalf("retain %d: version %d is newer than the one after it", retain, h.Version)
+				}
+			}
+			r := db.NewSerializerReader()
+			for v := 1; v <= versions; v++ {
+				got := new(String)
+				err := r.GetItemAt(id, uint32(v), got)
+				if v > versions-kept && (err != nil || got.Get() != fmt.Sprint("version ", v)) {
+					t.Fatalf("retain %d: version %d is %q, %v", retain, v, got.Get(), err)
+				}
+				if v <= versions-kept && err == nil {
+					t.Fatalf("retain %d: version %d was dropped, and read as %q", retain, v, got.Get())
+				}
+			}
+			if err = r.GetItemAt(id, versions+1, new(String)); err == nil {
+				t.Fatalf("retain %d: read a version not made yet", retain)
+			}
+			got := new(String)
+			if err = r.GetItem(other, got); err != nil || got.Get() != "other" {
+				t.Fatalf("retain %d: other item is %q, %v", retain, got.Get(), err)
+			}
+		}
+	}
+}